@@ -0,0 +1,242 @@
+package main
+
+import (
+	mrand "math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+const arrivalReportInterval = 10 * time.Second
+
+// ArrivalStep brings the total number of devices that came online up to
+// Devices once At has passed since the start of the run
+type ArrivalStep struct {
+	At      duration `json:"at"`
+	Devices int      `json:"devices"`
+}
+
+// Arrival describes when devices first come online
+type Arrival struct {
+	// Model is one of none, linear, rate, poisson or step
+	Model string `json:"model"`
+	// Duration to spread the devices over for the linear model
+	Duration duration `json:"duration"`
+	// Rate in devices per second for the rate and poisson models
+	Rate  float64       `json:"rate"`
+	Steps []ArrivalStep `json:"steps"`
+}
+
+// validate checks the arrival model for a run of total devices
+func (a *Arrival) validate(total int) error {
+	switch a.Model {
+	case "", "none":
+	case "linear":
+		if a.Duration <= 0 {
+			return errors.New("linear arrival needs a positive duration")
+		}
+	case "rate", "poisson":
+		if a.Rate <= 0 {
+			return errors.Errorf("%s arrival needs a positive rate", a.Model)
+		}
+	case "step":
+		if len(a.Steps) == 0 {
+			return errors.New("step arrival needs at least one step")
+		}
+		sort.Slice(a.Steps, func(i, j int) bool { return a.Steps[i].At < a.Steps[j].At })
+		// devices left out of the schedule would never be let through
+		if last := a.Steps[len(a.Steps)-1].Devices; last < total {
+			return errors.Errorf("step arrival schedule ends after %d devices, the run has %d", last, total)
+		}
+	default:
+		return errors.Errorf("unknown arrival model %q", a.Model)
+	}
+	return nil
+}
+
+// parseArrivalSteps parses a step schedule given as comma separated
+// <seconds>:<devices> pairs, e.g. "0:100,60:500,120:1000"
+func parseArrivalSteps(s string) ([]ArrivalStep, error) {
+	var steps []ArrivalStep
+	if s == "" {
+		return steps, nil
+	}
+	for _, e := range strings.Split(s, ",") {
+		pair := strings.Split(e, ":")
+		if len(pair) != 2 {
+			return nil, errors.Errorf("invalid arrival step %q, expected <seconds>:<devices>", e)
+		}
+		at, err := strconv.Atoi(strings.TrimSpace(pair[0]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid arrival step time %q", pair[0])
+		}
+		devices, err := strconv.Atoi(strings.TrimSpace(pair[1]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid arrival step device count %q", pair[1])
+		}
+		steps = append(steps, ArrivalStep{At: duration(time.Duration(at) * time.Second), Devices: devices})
+	}
+	return steps, nil
+}
+
+// arrivalGate hands out permissions for devices to come online according to
+// an arrival model and keeps track of the rate that was actually reached
+type arrivalGate struct {
+	arrival Arrival
+	total   int
+	start   time.Time
+
+	// lock guards the slots of the schedule: devices take them in the order
+	// they arrive at the gate, next is the one to take and last is when the
+	// previous one was let through
+	lock  sync.Mutex
+	slots []time.Duration
+	next  int
+	last  time.Time
+
+	started       int64
+	authenticated int64
+	// pending counts the slots not yet started or given up by a device
+	// stopped while waiting for it
+	pending int64
+}
+
+var arrivals *arrivalGate
+
+func newArrivalGate(a Arrival, total int) *arrivalGate {
+	g := &arrivalGate{
+		arrival: a,
+		total:   total,
+		start:   time.Now(),
+	}
+	if a.Model != "" && a.Model != "none" {
+		g.slots = g.offsets()
+		g.pending = int64(len(g.slots))
+	}
+	return g
+}
+
+// offsets computes when each of the devices may come online, relative to the
+// start of the run
+func (g *arrivalGate) offsets() []time.Duration {
+	offsets := make([]time.Duration, g.total)
+	elapsed := 0.0
+
+	for i := range offsets {
+		switch g.arrival.Model {
+		case "linear":
+			offsets[i] = time.Duration(g.arrival.Duration) * time.Duration(i) / time.Duration(g.total)
+		case "rate":
+			offsets[i] = time.Duration(float64(i) / g.arrival.Rate * float64(time.Second))
+		case "poisson":
+			// exponentially distributed inter-arrival times
+			if i > 0 {
+				elapsed += mrand.ExpFloat64() / g.arrival.Rate
+			}
+			offsets[i] = time.Duration(elapsed * float64(time.Second))
+		case "step":
+			for _, step := range g.arrival.Steps {
+				if i < step.Devices {
+					offsets[i] = time.Duration(step.At)
+					break
+				}
+			}
+		}
+	}
+	return offsets
+}
+
+// run reports on the arrivals of a run with an arrival model
+func (g *arrivalGate) run() {
+	if len(g.slots) == 0 {
+		return
+	}
+	log.Infof("bringing %d devices online using the %s arrival model", g.total, g.arrival.Model)
+	g.report()
+}
+
+// report periodically logs the arrival and authentication rates until every
+// device has been authenticated, or until the schedule is done and no more
+// devices are authenticated, as the rest were stopped or are rejected
+func (g *arrivalGate) report() {
+	ticker := time.NewTicker(arrivalReportInterval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	var lastStarted, lastAuthenticated int64
+	peak := 0.0
+
+	for range ticker.C {
+		started := atomic.LoadInt64(&g.started)
+		authenticated := atomic.LoadInt64(&g.authenticated)
+		interval := arrivalReportInterval.Seconds()
+		authRate := float64(authenticated-lastAuthenticated) / interval
+		if authRate > peak {
+			peak = authRate
+		}
+
+		log.Infof("arrivals: %d/%d started (%.2f/s), %d authenticated (%.2f/s)",
+			started, g.total, float64(started-lastStarted)/interval, authenticated, authRate)
+		stalled := authenticated == lastAuthenticated
+		lastStarted, lastAuthenticated = started, authenticated
+
+		elapsed := time.Since(start)
+		if authenticated >= int64(g.total) {
+			log.Infof("all %d devices authenticated in %v, average %.2f/s, peak %.2f/s",
+				g.total, elapsed.Round(time.Second), float64(authenticated)/elapsed.Seconds(), peak)
+			return
+		}
+		if stalled && atomic.LoadInt64(&g.pending) == 0 {
+			log.Infof("%d/%d devices authenticated in %v, average %.2f/s, peak %.2f/s; the others were stopped or are not accepted",
+				authenticated, g.total, elapsed.Round(time.Second), float64(authenticated)/elapsed.Seconds(), peak)
+			return
+		}
+	}
+}
+
+// wait blocks until the device is allowed to come online. Devices reaching
+// the gate after their slot, e.g. started late by a cohort timeline, keep the
+// spacing of the schedule rather than all coming online at once. Any device
+// started after the schedule is done is let through.
+func (g *arrivalGate) wait(stop <-chan struct{}) bool {
+	g.lock.Lock()
+	if g.next == len(g.slots) {
+		g.lock.Unlock()
+		return !stopped(stop)
+	}
+	at := g.start.Add(g.slots[g.next])
+	if g.next > 0 {
+		if paced := g.last.Add(g.slots[g.next] - g.slots[g.next-1]); paced.After(at) {
+			at = paced
+		}
+	}
+	if now := time.Now(); now.After(at) {
+		at = now
+	}
+	g.last = at
+	g.next++
+	g.lock.Unlock()
+
+	arrived := sleep(time.Until(at), stop)
+	if arrived {
+		deviceArrivals.Inc()
+		atomic.AddInt64(&g.started, 1)
+	}
+	if atomic.AddInt64(&g.pending, -1) == 0 {
+		started := atomic.LoadInt64(&g.started)
+		elapsed := time.Since(g.start)
+		log.Infof("arrival schedule done: %d devices started in %v (%.2f devices/s)",
+			started, elapsed.Round(time.Second), float64(started)/elapsed.Seconds())
+	}
+	return arrived
+}
+
+func (g *arrivalGate) deviceAuthenticated() {
+	atomic.AddInt64(&g.authenticated, 1)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseArrivalSteps(t *testing.T) {
+	step := func(at, devices int) ArrivalStep {
+		return ArrivalStep{At: duration(time.Duration(at) * time.Second), Devices: devices}
+	}
+
+	tests := []struct {
+		steps string
+		want  []ArrivalStep
+		err   bool
+	}{
+		{steps: "", want: nil},
+		{steps: "0:100", want: []ArrivalStep{step(0, 100)}},
+		{steps: "0:100,60:500, 120 : 1000", want: []ArrivalStep{step(0, 100), step(60, 500), step(120, 1000)}},
+		{steps: "0", err: true},
+		{steps: "0:1:2", err: true},
+		{steps: "x:100", err: true},
+		{steps: "0:y", err: true},
+	}
+	for _, test := range tests {
+		steps, err := parseArrivalSteps(test.steps)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.steps, steps)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.steps, err)
+			continue
+		}
+		if !reflect.DeepEqual(steps, test.want) {
+			t.Errorf("%q: got %v, want %v", test.steps, steps, test.want)
+		}
+	}
+}
+
+func TestArrivalValidate(t *testing.T) {
+	steps := func(pairs ...int) []ArrivalStep {
+		var s []ArrivalStep
+		for i := 0; i < len(pairs); i += 2 {
+			s = append(s, ArrivalStep{At: duration(time.Duration(pairs[i]) * time.Second), Devices: pairs[i+1]})
+		}
+		return s
+	}
+
+	tests := []struct {
+		name    string
+		arrival Arrival
+		err     bool
+	}{
+		{name: "none", arrival: Arrival{Model: "none"}},
+		{name: "unset", arrival: Arrival{}},
+		{name: "linear", arrival: Arrival{Model: "linear", Duration: duration(time.Minute)}},
+		{name: "linear without duration", arrival: Arrival{Model: "linear"}, err: true},
+		{name: "rate", arrival: Arrival{Model: "rate", Rate: 5}},
+		{name: "poisson without rate", arrival: Arrival{Model: "poisson"}, err: true},
+		{name: "step", arrival: Arrival{Model: "step", Steps: steps(0, 5, 60, 10)}},
+		{name: "step out of order", arrival: Arrival{Model: "step", Steps: steps(60, 10, 0, 5)}},
+		{name: "step without steps", arrival: Arrival{Model: "step"}, err: true},
+		{name: "step not covering the run", arrival: Arrival{Model: "step", Steps: steps(0, 5, 60, 8)}, err: true},
+		{name: "unknown", arrival: Arrival{Model: "burst"}, err: true},
+	}
+	for _, test := range tests {
+		err := test.arrival.validate(10)
+		if test.err && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		} else if !test.err && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestArrivalOffsets(t *testing.T) {
+	offsets := func(a Arrival, total int) []time.Duration {
+		if err := a.validate(total); err != nil {
+			t.Fatal(err)
+		}
+		return newArrivalGate(a, total).slots
+	}
+	seconds := func(s ...float64) []time.Duration {
+		d := make([]time.Duration, len(s))
+		for i := range s {
+			d[i] = time.Duration(s[i] * float64(time.Second))
+		}
+		return d
+	}
+
+	if slots := offsets(Arrival{Model: "none"}, 3); slots != nil {
+		t.Errorf("none: got slots %v", slots)
+	}
+
+	linear := offsets(Arrival{Model: "linear", Duration: duration(4 * time.Second)}, 4)
+	if want := seconds(0, 1, 2, 3); !reflect.DeepEqual(linear, want) {
+		t.Errorf("linear: got %v, want %v", linear, want)
+	}
+
+	rate := offsets(Arrival{Model: "rate", Rate: 2}, 4)
+	if want := seconds(0, 0.5, 1, 1.5); !reflect.DeepEqual(rate, want) {
+		t.Errorf("rate: got %v, want %v", rate, want)
+	}
+
+	// steps are sorted by validate
+	step := offsets(Arrival{Model: "step", Steps: []ArrivalStep{
+		{At: duration(10 * time.Second), Devices: 5},
+		{At: 0, Devices: 2},
+	}}, 5)
+	if want := seconds(0, 0, 10, 10, 10); !reflect.DeepEqual(step, want) {
+		t.Errorf("step: got %v, want %v", step, want)
+	}
+
+	poisson := offsets(Arrival{Model: "poisson", Rate: 10}, 100)
+	if poisson[0] != 0 {
+		t.Errorf("poisson: first device arrives at %v", poisson[0])
+	}
+	for i := 1; i < len(poisson); i++ {
+		if poisson[i] < poisson[i-1] {
+			t.Fatalf("poisson: device %d arrives at %v, before device %d at %v", i, poisson[i], i-1, poisson[i-1])
+		}
+	}
+}
+
+func TestScenarioArrivalFallsBackToSteps(t *testing.T) {
+	path, cleanup := writeScenario(t, `{"cohorts": [{"name": "a", "count": 2}]}`)
+	defer cleanup()
+
+	defer func(model string, steps []ArrivalStep) {
+		arrivalModel, defaultArrivalSteps = model, steps
+	}(arrivalModel, defaultArrivalSteps)
+	arrivalModel = "step"
+	defaultArrivalSteps = []ArrivalStep{{At: 0, Devices: 2}}
+
+	s, err := loadScenario(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Arrival.validate(s.deviceCount()); err != nil {
+		t.Errorf("arrival of the flags: %v", err)
+	}
+}
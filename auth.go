@@ -1,7 +1,12 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
@@ -49,6 +54,84 @@ func (m *FakeMenderAuthManager) MakeAuthRequest() (*client.AuthRequest, error) {
 	}, nil
 }
 
+// isUnauthorized tells whether the backend refused the token of a device;
+// only update checks have a dedicated error, the other calls just mention
+// the status code
+func isUnauthorized(err error) bool {
+	return err != nil && (err == client.ErrNotAuthorized ||
+		strings.HasSuffix(err.Error(), fmt.Sprintf("bad status %d", http.StatusUnauthorized)))
+}
+
+// withReauth runs fn, and if the backend no longer accepts the token of the
+// device, authenticates again and runs fn once more
+func withReauth(api *client.ApiClient, dev *fakeDevice, stop <-chan struct{}, fn func() error) error {
+	err := fn()
+	if !isUnauthorized(err) {
+		return err
+	}
+
+	log.Infof("device %s: auth token refused, authenticating again", dev.name())
+	stats.recordRefresh()
+	if !clientAuthenticate(api, dev, stop) {
+		return err
+	}
+	return fn()
+}
+
+// RecvAuthResponse hands the token issued by the backend to the device, which
+// keeps it in its store. Tokens that are not JWTs, e.g. of a proxy issuing
+// opaque tokens, are used as they are; without an expiry they are not
+// refreshed early, only once the backend refuses them.
 func (m *FakeMenderAuthManager) RecvAuthResponse(data []byte) error {
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return errors.New("empty auth token")
+	}
+	claims, err := parseTokenClaims(token)
+	if err != nil {
+		claims = tokenClaims{}
+	}
+	m.device.setAuthToken(client.AuthToken(token), claims)
+
+	if err != nil {
+		log.Infof("device %s %s: authenticated with an opaque token: %v", m.device.name(), m.idSrc, err)
+		return nil
+	}
+	log.Infof("device %s %s: authenticated as device ID %s (tenant %q, token expires %v)",
+		m.device.name(), m.idSrc, claims.DeviceID, claims.Tenant, claims.expiry())
 	return nil
 }
+
+// tokenClaims are the claims of a device JWT the simulation cares about
+type tokenClaims struct {
+	DeviceID string `json:"sub"`
+	Tenant   string `json:"mender.tenant"`
+	Expires  int64  `json:"exp"`
+}
+
+// expiry is the zero time if the token does not expire
+func (c tokenClaims) expiry() time.Time {
+	if c.Expires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(c.Expires, 0)
+}
+
+// parseTokenClaims decodes the claims of a JWT without verifying its
+// signature, which only the backend can do
+func parseTokenClaims(token string) (tokenClaims, error) {
+	var claims tokenClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return claims, errors.Wrapf(err, "failed to decode token claims")
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errors.Wrapf(err, "failed to parse token claims")
+	}
+	return claims, nil
+}
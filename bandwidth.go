@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	mrand "math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// minimum rate a normally distributed device download rate is clamped to,
+// in bytes per second
+const minDownloadRate = 128
+
+// parseBitrate parses a rate like "512kbit", "1.5mbit" or "2000000" (bits
+// per second) and returns it in bytes per second
+func parseBitrate(s string) (float64, error) {
+	v := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "/s")
+
+	multiplier := 1.0
+	for _, unit := range []struct {
+		suffix string
+		factor float64
+	}{
+		{"gbit", 1e9},
+		{"mbit", 1e6},
+		{"kbit", 1e3},
+		{"bit", 1},
+	} {
+		if strings.HasSuffix(v, unit.suffix) {
+			multiplier = unit.factor
+			v = strings.TrimSuffix(v, unit.suffix)
+			break
+		}
+	}
+
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil || rate <= 0 {
+		return 0, errors.Errorf("invalid bit rate %q", s)
+	}
+	return rate * multiplier / 8, nil
+}
+
+// Bandwidth describes the download rate of the devices of a cohort. It is
+// written as a fixed rate ("512kbit"), a uniformly distributed range
+// ("128kbit-2mbit") or a normal distribution given as mean and standard
+// deviation ("512kbit~128kbit"); empty means unlimited.
+type Bandwidth struct {
+	spec string
+	// all rates in bytes per second
+	min, max     float64
+	mean, stddev float64
+}
+
+func parseBandwidth(spec string) (Bandwidth, error) {
+	b := Bandwidth{spec: spec}
+	var err error
+
+	switch {
+	case spec == "":
+	case strings.Contains(spec, "-"):
+		parts := strings.SplitN(spec, "-", 2)
+		if b.min, err = parseBitrate(parts[0]); err != nil {
+			return b, err
+		}
+		if b.max, err = parseBitrate(parts[1]); err != nil {
+			return b, err
+		}
+		if b.min > b.max {
+			return b, errors.Errorf("invalid bandwidth range %q", spec)
+		}
+	case strings.Contains(spec, "~"):
+		parts := strings.SplitN(spec, "~", 2)
+		if b.mean, err = parseBitrate(parts[0]); err != nil {
+			return b, err
+		}
+		if b.stddev, err = parseBitrate(parts[1]); err != nil {
+			return b, err
+		}
+	default:
+		if b.min, err = parseBitrate(spec); err != nil {
+			return b, err
+		}
+		b.max = b.min
+	}
+	return b, nil
+}
+
+func (b *Bandwidth) UnmarshalJSON(data []byte) error {
+	var spec string
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return err
+	}
+	parsed, err := parseBandwidth(spec)
+	if err != nil {
+		return err
+	}
+	*b = parsed
+	return nil
+}
+
+func (b Bandwidth) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.spec)
+}
+
+// draw picks the download rate of one device, in bytes per second; zero
+// means unlimited
+func (b Bandwidth) draw() float64 {
+	switch {
+	case b.mean > 0:
+		rate := b.mean + mrand.NormFloat64()*b.stddev
+		if rate < minDownloadRate {
+			rate = minDownloadRate
+		}
+		return rate
+	case b.max > b.min:
+		return b.min + mrand.Float64()*(b.max-b.min)
+	}
+	return b.min
+}
+
+// rateLimiter is a token bucket handing out bytes at a fixed rate
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond float64) *rateLimiter {
+	return &rateLimiter{
+		rate: bytesPerSecond,
+		last: time.Now(),
+	}
+}
+
+// chunk is the largest read that keeps the transfer reasonably smooth
+func (l *rateLimiter) chunk() int {
+	n := int(l.rate / 10)
+	if n < 512 {
+		n = 512
+	}
+	if n > 32*1024 {
+		n = 32 * 1024
+	}
+	return n
+}
+
+// wait blocks until n bytes may be passed on
+func (l *rateLimiter) wait(n int) {
+	l.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	// allow bursts of at most one second worth of data
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.Unlock()
+
+	time.Sleep(delay)
+}
+
+// fleetLimiter caps the download rate of all devices together; nil if
+// unlimited
+var fleetLimiter *rateLimiter
+
+// shapedReader passes data on no faster than all of its limiters allow
+type shapedReader struct {
+	r        io.Reader
+	limiters []*rateLimiter
+}
+
+func shapeReader(r io.Reader, limiters ...*rateLimiter) io.Reader {
+	var active []*rateLimiter
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return r
+	}
+	return &shapedReader{r: r, limiters: active}
+}
+
+func (s *shapedReader) Read(p []byte) (int, error) {
+	for _, l := range s.limiters {
+		if c := l.chunk(); len(p) > c {
+			p = p[:c]
+		}
+	}
+	n, err := s.r.Read(p)
+	for _, l := range s.limiters {
+		l.wait(n)
+	}
+	return n, err
+}
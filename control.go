@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// broadcast wakes up every device waiting on it at once
+type broadcast struct {
+	lock sync.Mutex
+	ch   chan struct{}
+}
+
+func (b *broadcast) wait() <-chan struct{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.ch == nil {
+		b.ch = make(chan struct{})
+	}
+	return b.ch
+}
+
+func (b *broadcast) fire() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.ch != nil {
+		close(b.ch)
+		b.ch = nil
+	}
+}
+
+// settings of a cohort the control API changes at runtime are read through
+// these
+
+func (c *Cohort) pollInterval() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return time.Duration(c.PollInterval)
+}
+
+func (c *Cohort) inventoryInterval() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return time.Duration(c.InventoryInterval)
+}
+
+func (c *Cohort) maxWait() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return time.Duration(c.MaxWait)
+}
+
+// isPaused tells whether the devices of the cohort hold off checking for
+// updates and submitting their inventory
+func (c *Cohort) isPaused() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.paused
+}
+
+// errTimelineRunning refuses changes to the number of devices of a cohort
+// while its timeline sets it
+var errTimelineRunning = errors.New("the cohort timeline is running, devices cannot be changed until it has finished")
+
+// cohortStatus is a cohort as the control API shows it
+type cohortStatus struct {
+	Name string `json:"name"`
+	// Devices is the number of running devices, Total includes the
+	// stopped ones
+	Devices           int      `json:"devices"`
+	Total             int      `json:"total"`
+	Paused            bool     `json:"paused"`
+	PollInterval      duration `json:"poll_interval"`
+	InventoryInterval duration `json:"inventory_interval"`
+	MaxWait           duration `json:"max_wait"`
+	FailureRatio      float64  `json:"failure_ratio"`
+}
+
+// cohortChange holds the settings to change of a cohort, nil ones are left
+// as they are
+type cohortChange struct {
+	Devices           *int      `json:"devices"`
+	Paused            *bool     `json:"paused"`
+	PollInterval      *duration `json:"poll_interval"`
+	InventoryInterval *duration `json:"inventory_interval"`
+	MaxWait           *duration `json:"max_wait"`
+	FailureRatio      *float64  `json:"failure_ratio"`
+}
+
+func (ch *cohortChange) validate() error {
+	switch {
+	case ch.Devices != nil && *ch.Devices < 0:
+		return errors.New("devices must not be negative")
+	case ch.PollInterval != nil && *ch.PollInterval <= 0:
+		return errors.New("poll_interval must be positive")
+	case ch.InventoryInterval != nil && *ch.InventoryInterval <= 0:
+		return errors.New("inventory_interval must be positive")
+	case ch.MaxWait != nil && *ch.MaxWait < 0:
+		return errors.New("max_wait must not be negative")
+	case ch.FailureRatio != nil && (*ch.FailureRatio < 0 || *ch.FailureRatio > 1):
+		return errors.New("failure_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+func (c *Cohort) status() cohortStatus {
+	c.runLock.Lock()
+	devices, total := len(c.stops), len(c.devices)
+	c.runLock.Unlock()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return cohortStatus{
+		Name:              c.Name,
+		Devices:           devices,
+		Total:             total,
+		Paused:            c.paused,
+		PollInterval:      c.PollInterval,
+		InventoryInterval: c.InventoryInterval,
+		MaxWait:           c.MaxWait,
+		FailureRatio:      c.FailureRatio,
+	}
+}
+
+// apply changes the settings of the cohort; running devices pick up new
+// intervals right away, with their timers started over. Changing the number
+// of devices or the failure ratio starts a new round of updates.
+func (c *Cohort) apply(ch cohortChange) error {
+	c.lock.Lock()
+	if ch.Devices != nil && c.timeline {
+		c.lock.Unlock()
+		return errTimelineRunning
+	}
+	if ch.Devices != nil {
+		c.Count = *ch.Devices
+	}
+	if ch.Paused != nil {
+		c.paused = *ch.Paused
+	}
+	if ch.PollInterval != nil {
+		c.PollInterval = *ch.PollInterval
+	}
+	if ch.InventoryInterval != nil {
+		c.InventoryInterval = *ch.InventoryInterval
+	}
+	if ch.MaxWait != nil {
+		c.MaxWait = *ch.MaxWait
+	}
+	if ch.FailureRatio != nil {
+		c.FailureRatio = *ch.FailureRatio
+	}
+	if ch.Devices != nil || ch.FailureRatio != nil {
+		c.failCount = int(math.Round(c.FailureRatio * float64(c.Count)))
+		c.updatesLeftToFail = c.failCount
+		c.updatesPerformed = 0
+	}
+	c.lock.Unlock()
+
+	if ch.PollInterval != nil || ch.InventoryInterval != nil {
+		c.reconfigured.fire()
+	}
+	return nil
+}
+
+// controlServer serves the control API, which reshapes a running load test
+// without restarting it
+type controlServer struct {
+	// lock serializes changes, the fleet is not safe for concurrent use
+	lock     sync.Mutex
+	scenario *Scenario
+	fleet    *fleet
+}
+
+func startControlServer(addr string, scenario *Scenario, f *fleet) {
+	s := &controlServer{scenario: scenario, fleet: f}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cohorts", s.handleCohorts)
+	mux.HandleFunc("/cohorts/", s.handleCohort)
+	mux.HandleFunc("/poll", s.handlePoll)
+
+	log.Infof("serving control API on http://%s/cohorts", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatal("control API listener failed: ", err)
+		}
+	}()
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleCohorts lists the cohorts
+func (s *controlServer) handleCohorts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var cohorts []cohortStatus
+	for _, c := range s.scenario.Cohorts {
+		cohorts = append(cohorts, c.status())
+	}
+	writeJSON(w, cohorts)
+}
+
+// handleCohort shows a cohort (GET), changes its settings (PATCH) and
+// pauses, resumes or polls it (POST to /pause, /resume or /poll)
+func (s *controlServer) handleCohort(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/cohorts/"), "/", 2)
+	var cohort *Cohort
+	for _, c := range s.scenario.Cohorts {
+		if c.Name == parts[0] {
+			cohort = c
+		}
+	}
+	if cohort == nil {
+		http.Error(w, "no such cohort", http.StatusNotFound)
+		return
+	}
+
+	var ch cohortChange
+	if len(parts) == 2 {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch parts[1] {
+		case "pause", "resume":
+			paused := parts[1] == "pause"
+			ch.Paused = &paused
+		case "poll":
+			cohort.pollNow.fire()
+			log.Infof("control: cohort %s polling now", cohort.Name)
+			writeJSON(w, cohort.status())
+			return
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+	} else {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, cohort.status())
+			return
+		case http.MethodPatch:
+			if err := json.NewDecoder(r.Body).Decode(&ch); err != nil {
+				http.Error(w, "invalid cohort change: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+	}
+
+	if err := ch.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.change(cohort, ch); err == errTimelineRunning {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Errorf("control: cohort %s: %v", cohort.Name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, cohort.status())
+}
+
+// handlePoll makes the devices of all cohorts check for updates right away
+func (s *controlServer) handlePoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	for _, c := range s.scenario.Cohorts {
+		c.pollNow.fire()
+	}
+	log.Info("control: all cohorts polling now")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// change applies the change to the cohort, generating keys for the devices
+// it does not have yet
+func (s *controlServer) change(c *Cohort, ch cohortChange) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := c.apply(ch); err != nil {
+		return err
+	}
+	log.Infof("control: cohort %s changed", c.Name)
+	if ch.Devices == nil {
+		return nil
+	}
+
+	c.runLock.Lock()
+	missing := *ch.Devices - len(c.devices)
+	c.runLock.Unlock()
+	if missing > 0 {
+		devices, err := s.fleet.generate(missing, c.KeyType, c.Name, nil, c.Identity, runtime.NumCPU())
+		if err != nil {
+			return errors.Wrapf(err, "failed to generate crypto keys")
+		}
+		if err := s.fleet.save(); err != nil {
+			return err
+		}
+		var keys []assignedKey
+		for _, d := range devices {
+			keys = append(keys, assignedKey{index: d.Index, path: s.fleet.keyFile(d)})
+		}
+		c.addDevices(keys)
+	}
+	c.setActive(*ch.Devices)
+	log.Infof("control: cohort %s running %d devices", c.Name, c.active())
+	return nil
+}
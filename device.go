@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+)
+
+// number of authorization requests refused in a row after which a device
+// counts as rejected
+const rejectedAfter = 3
+
+// share of the token lifetime after which a device authenticates again,
+// before the token expires
+const tokenRefreshAt = 0.9
+
+// how long to wait for a token refresh when the token does not expire
+const noTokenRefresh = 24 * time.Hour
+
+// shortest wait for a token refresh, so a token expiring right away does not
+// make the device authenticate again and again
+const minTokenRefresh = 5 * time.Second
+
+// updateRecord is one entry of a device's update history
+type updateRecord struct {
+	DeploymentID string    `json:"deployment_id"`
+	ArtifactName string    `json:"artifact_name"`
+	Outcome      string    `json:"outcome"`
+	Finished     time.Time `json:"finished"`
+}
+
+// deploymentState tracks the update a device is in the middle of, so that it
+// can be finished after a restart
+type deploymentState struct {
+	Update client.UpdateResponse `json:"update"`
+	// Cycle holds the statuses the device goes through, Next is the index of
+	// the one to report next
+	Cycle []string `json:"cycle"`
+	Next  int      `json:"next"`
+	// FailMessage overrides the message of the cohort in the failure logs
+	FailMessage string `json:"fail_message,omitempty"`
+}
+
+// fakeDevice holds the state of a single simulated device
+type fakeDevice struct {
+	lock sync.Mutex
+
+	storeFile    string
+	index        int
+	identity     map[string]string
+	cohort       *Cohort
+	artifactName string
+	deviceType   string
+	token        client.AuthToken
+	claims       tokenClaims
+	tokenIssued  time.Time
+	rejected     bool
+	deployment   *deploymentState
+	history      []updateRecord
+	// generated holds the values of the inventory model of the cohort
+	generated *deviceInventory
+	// submitted is the last inventory submitted, without the time
+	submitted string
+
+	// downloadLimiter shapes artifact downloads, nil if unlimited
+	downloadLimiter *rateLimiter
+
+	// exited is closed once the last started scheduler of the device has
+	// returned; guarded by the runLock of the cohort
+	exited chan struct{}
+}
+
+func newFakeDevice(storeFile string, index int, identity map[string]string, cohort *Cohort) *fakeDevice {
+	d := &fakeDevice{
+		storeFile:    storeFile,
+		index:        index,
+		identity:     identity,
+		cohort:       cohort,
+		artifactName: cohort.Artifact,
+		deviceType:   cohort.DeviceType,
+	}
+	if rate := cohort.DownloadRate.draw(); rate > 0 {
+		d.downloadLimiter = newRateLimiter(rate)
+	}
+	return d
+}
+
+func (d *fakeDevice) name() string {
+	return strings.TrimSuffix(filepath.Base(d.storeFile), keySuffix)
+}
+
+func (d *fakeDevice) current() client.CurrentUpdate {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return client.CurrentUpdate{DeviceType: d.deviceType, Artifact: d.artifactName}
+}
+
+func (d *fakeDevice) authToken() client.AuthToken {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.token
+}
+
+func (d *fakeDevice) setAuthToken(token client.AuthToken, claims tokenClaims) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.token = token
+	d.claims = claims
+	d.tokenIssued = time.Now()
+	d.save()
+}
+
+// tokenClaims returns the claims of the current auth token
+func (d *fakeDevice) tokenClaims() tokenClaims {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.claims
+}
+
+// untilTokenRefresh returns how long the current token is used before the
+// device authenticates again, zero or less once the refresh is due. Tokens
+// that expired by the time they were received, e.g. because of clock skew,
+// are not refreshed early.
+func (d *fakeDevice) untilTokenRefresh() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	expiry := d.claims.expiry()
+	if expiry.IsZero() || !expiry.After(d.tokenIssued) {
+		return noTokenRefresh
+	}
+	lifetime := expiry.Sub(d.tokenIssued)
+	return time.Until(d.tokenIssued.Add(time.Duration(float64(lifetime) * tokenRefreshAt)))
+}
+
+// tokenRefreshDelay is untilTokenRefresh for the refresh timer, at least
+// minTokenRefresh
+func (d *fakeDevice) tokenRefreshDelay() time.Duration {
+	if wait := d.untilTokenRefresh(); wait > minTokenRefresh {
+		return wait
+	}
+	return minTokenRefresh
+}
+
+// setRejected marks whether the authorization requests of the device keep
+// being refused
+func (d *fakeDevice) setRejected(rejected bool) {
+	d.lock.Lock()
+	changed := d.rejected != rejected
+	d.rejected = rejected
+	d.lock.Unlock()
+
+	if !changed {
+		return
+	}
+	if rejected {
+		log.Warnf("device %s: rejected by the backend", d.name())
+	}
+	stats.setRejected(d.name(), rejected)
+}
+
+// pendingDeployment returns the deployment interrupted by a restart, if any
+func (d *fakeDevice) pendingDeployment() *deploymentState {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.deployment
+}
+
+func (d *fakeDevice) startUpdate(update client.UpdateResponse, cycle []string) *deploymentState {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.deployment = &deploymentState{Update: update, Cycle: cycle}
+	d.save()
+	return d.deployment
+}
+
+// advanceUpdate records that the status at index step has been reported
+func (d *fakeDevice) advanceUpdate(step int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.deployment != nil {
+		d.deployment.Next = step + 1
+		d.save()
+	}
+}
+
+// failUpdate makes the deployment fail right after the status at index step
+func (d *fakeDevice) failUpdate(step int, msg string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.deployment != nil {
+		cycle := append([]string(nil), d.deployment.Cycle[:step+1]...)
+		d.deployment.Cycle = append(cycle, "failure")
+		d.deployment.FailMessage = msg
+		d.save()
+	}
+}
+
+// finishUpdate records the outcome of a deployment; a successful one makes
+// the device run the deployed artifact from now on
+func (d *fakeDevice) finishUpdate(update client.UpdateResponse, outcome string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if outcome == outcomeSuccess {
+		d.artifactName = update.ArtifactName()
+	}
+	d.deployment = nil
+	d.history = append(d.history, updateRecord{
+		DeploymentID: update.ID,
+		ArtifactName: update.ArtifactName(),
+		Outcome:      outcome,
+		Finished:     time.Now(),
+	})
+	if len(d.history) > maxHistory {
+		d.history = d.history[len(d.history)-maxHistory:]
+	}
+	d.save()
+}
+
+// inventory returns the configured inventory of the cohort and the values
+// generated by its inventory model, together with the attributes describing
+// what the device is running
+func (d *fakeDevice) inventory() []client.InventoryAttribute {
+	current := d.current()
+
+	var attrs []client.InventoryAttribute
+	set := make(map[string]bool)
+	for _, attr := range d.cohort.inventory {
+		if attr.Name != "artifact_name" && attr.Name != "device_type" {
+			attrs = append(attrs, attr)
+			set[attr.Name] = true
+		}
+	}
+	if !set["time"] {
+		attrs = append(attrs, client.InventoryAttribute{Name: "time", Value: time.Now().Unix()})
+		set["time"] = true
+	}
+	if len(d.cohort.InventoryModel) > 0 {
+		d.lock.Lock()
+		if d.generated == nil {
+			d.generated = newDeviceInventory(d.cohort.InventoryModel, d.name(), d.index)
+		}
+		generated := d.generated.attributes()
+		d.lock.Unlock()
+
+		for _, attr := range generated {
+			if !set[attr.Name] && attr.Name != "artifact_name" && attr.Name != "device_type" {
+				attrs = append(attrs, attr)
+			}
+		}
+	}
+	return append(attrs,
+		client.InventoryAttribute{Name: "artifact_name", Value: current.Artifact},
+		client.InventoryAttribute{Name: "device_type", Value: current.DeviceType},
+	)
+}
+
+// inventoryKey identifies the inventory for comparing it with the submitted
+// one; the time is left out as it always changes
+func inventoryKey(attrs []client.InventoryAttribute) string {
+	var rest []client.InventoryAttribute
+	for _, attr := range attrs {
+		if attr.Name != "time" {
+			rest = append(rest, attr)
+		}
+	}
+	data, _ := json.Marshal(rest)
+	return string(data)
+}
+
+// inventoryChanged tells whether the inventory differs from the one
+// submitted last
+func (d *fakeDevice) inventoryChanged(attrs []client.InventoryAttribute) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.submitted != inventoryKey(attrs)
+}
+
+func (d *fakeDevice) inventorySubmitted(attrs []client.InventoryAttribute) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.submitted = inventoryKey(attrs)
+}
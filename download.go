@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender-artifact/areader"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// download modes
+const (
+	// plain GET of the artifact, ignoring its contents
+	downloadPlain = "plain"
+	// UpdateClient.FetchUpdate with resume on broken connections and a
+	// size check, like the real client does
+	downloadFetch = "fetch"
+	// as fetch, additionally parsing the artifact and verifying checksums
+	downloadValidate = "validate"
+)
+
+// how long a broken download is retried before giving up
+const downloadResumeMaxWait = 5 * time.Minute
+
+func validDownloadMode(mode string) bool {
+	switch mode {
+	case downloadPlain, downloadFetch, downloadValidate:
+		return true
+	}
+	return false
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// downloadUpdate fetches the artifact of the update the way the cohort of
+// the device is configured to
+func downloadUpdate(api *client.ApiClient, update client.UpdateResponse, dev *fakeDevice) error {
+	mode := dev.cohort.Download
+	if mode == "" || mode == downloadPlain {
+		return downloadToDevNull(update.URI(), dev.cohort.Faults, dev.downloadLimiter, fleetLimiter)
+	}
+
+	start := time.Now()
+	err := fetchUpdate(api, update, dev, mode == downloadValidate)
+	downloadDuration.ObserveDuration(start, resultLabel(err))
+	return err
+}
+
+func fetchUpdate(api *client.ApiClient, update client.UpdateResponse, dev *fakeDevice, validate bool) error {
+	log.Info("fetching update ", update.URI())
+	stream, size, err := client.NewUpdate().FetchUpdate(api, update.URI(), downloadResumeMaxWait)
+	if err != nil {
+		return errors.Wrapf(err, "failed to fetch update")
+	}
+	defer stream.Close()
+
+	counter := &countingReader{r: shapeReader(stream, dev.downloadLimiter, fleetLimiter)}
+	defer func() { downloadBytes.Add(float64(counter.n)) }()
+
+	if validate {
+		if err := validateArtifact(counter, update, dev.current().DeviceType); err != nil {
+			return err
+		}
+	}
+
+	// drain whatever the artifact reader left over
+	if _, err := io.Copy(ioutil.Discard, counter); err != nil {
+		return errors.Wrapf(err, "failed to download update")
+	}
+	if counter.n != size {
+		return errors.Errorf("artifact size mismatch: expected %d bytes, got %d", size, counter.n)
+	}
+
+	log.Debugf("fetched %d bytes of %s", counter.n, update.ArtifactName())
+	return nil
+}
+
+// validateArtifact parses the artifact stream, verifying the checksums of
+// all payloads and that the artifact matches the deployment
+func validateArtifact(r io.Reader, update client.UpdateResponse, deviceType string) error {
+	ar := areader.NewReader(r)
+
+	rootfs := handlers.NewRootfsInstaller()
+	rootfs.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+	if err := ar.RegisterHandler(rootfs); err != nil {
+		return errors.Wrapf(err, "failed to register artifact handler")
+	}
+
+	ar.CompatibleDevicesCallback = func(devices []string) error {
+		for _, dev := range devices {
+			if dev == deviceType {
+				return nil
+			}
+		}
+		return errors.Errorf("artifact not compatible with device type %s: %v", deviceType, devices)
+	}
+
+	if err := ar.ReadArtifact(); err != nil {
+		return errors.Wrapf(err, "invalid artifact")
+	}
+	if name := ar.GetArtifactName(); name != update.ArtifactName() {
+		return errors.Errorf("artifact name %q does not match deployment artifact %q", name, update.ArtifactName())
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Faults describes the network faults injected into the traffic of the
+// devices of a cohort; every rate is the probability of the fault hitting a
+// single request
+type Faults struct {
+	// Latency is added to every request, plus a random amount up to Jitter
+	Latency duration `json:"latency"`
+	Jitter  duration `json:"jitter"`
+	// ResetRate fails the request with a connection reset once it has been
+	// sent, so the server handles it but the device never sees the response
+	ResetRate float64 `json:"reset_rate"`
+	// PartialUploadRate cuts the request body off half way through
+	PartialUploadRate float64 `json:"partial_upload_rate"`
+	// PartialBodyRate cuts the response body off half way through
+	PartialBodyRate float64 `json:"partial_body_rate"`
+	// DNSRate fails the request as if the backend name did not resolve
+	DNSRate float64 `json:"dns_rate"`
+	// TimeoutRate makes the request hang for Timeout and then fail
+	TimeoutRate float64  `json:"timeout_rate"`
+	Timeout     duration `json:"timeout"`
+}
+
+func (f *Faults) enabled() bool {
+	return f != nil && (f.Latency > 0 || f.Jitter > 0 || f.ResetRate > 0 ||
+		f.PartialUploadRate > 0 || f.PartialBodyRate > 0 || f.DNSRate > 0 || f.TimeoutRate > 0)
+}
+
+func (f *Faults) validate() error {
+	if f == nil {
+		return nil
+	}
+	for _, rate := range []float64{f.ResetRate, f.PartialUploadRate, f.PartialBodyRate, f.DNSRate, f.TimeoutRate} {
+		if rate < 0 || rate > 1 {
+			return errors.New("fault rates must be between 0 and 1")
+		}
+	}
+	if f.Latency < 0 || f.Jitter < 0 || f.Timeout < 0 {
+		return errors.New("fault durations must not be negative")
+	}
+	return nil
+}
+
+// timeoutError looks like the error of a request timing out on the network
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "injected fault: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func hit(rate float64) bool {
+	return rate > 0 && mrand.Float64() < rate
+}
+
+// faultTransport injects the configured faults into the requests it passes on
+type faultTransport struct {
+	next   http.RoundTripper
+	faults *Faults
+}
+
+// withFaults wraps the transport with fault injection if any is configured
+func withFaults(next http.RoundTripper, faults *Faults) http.RoundTripper {
+	if !faults.enabled() {
+		return next
+	}
+	return &faultTransport{next: next, faults: faults}
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f := t.faults
+
+	delay := time.Duration(f.Latency)
+	if f.Jitter > 0 {
+		delay += time.Duration(mrand.Int63n(int64(f.Jitter)))
+	}
+	time.Sleep(delay)
+
+	if hit(f.DNSRate) {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{
+			Err:        "no such host (injected fault)",
+			Name:       req.URL.Hostname(),
+			IsNotFound: true,
+		}}
+	}
+
+	if hit(f.TimeoutRate) {
+		select {
+		case <-time.After(time.Duration(f.Timeout)):
+		case <-req.Context().Done():
+		}
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}
+	}
+
+	if req.Body != nil && req.ContentLength > 1 && hit(f.PartialUploadRate) {
+		// a RoundTripper must not modify the request of the caller
+		req = req.Clone(req.Context())
+		req.Body = &truncatedReader{
+			ReadCloser: req.Body,
+			left:       req.ContentLength / 2,
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if hit(f.ResetRate) {
+		resp.Body.Close()
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+
+	if resp.ContentLength > 1 && hit(f.PartialBodyRate) {
+		resp.Body = &truncatedReader{
+			ReadCloser: resp.Body,
+			left:       resp.ContentLength / 2,
+		}
+	}
+	return resp, nil
+}
+
+// truncatedReader fails with an unexpected EOF after passing on left bytes
+type truncatedReader struct {
+	io.ReadCloser
+	left int64
+}
+
+func (r *truncatedReader) Read(p []byte) (int, error) {
+	if r.left <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.left -= int64(n)
+	return n, err
+}
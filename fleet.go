@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// fleetManifestName is the file in the key directory listing all devices,
+// so runs do not have to glob the key directory
+const fleetManifestName = "fleet.json"
+
+// fleetDevice is a device of the fleet manifest
+type fleetDevice struct {
+	Index int `json:"index"`
+	// Key is the path of the key file, relative to the key directory
+	Key     string `json:"key"`
+	KeyType string `json:"key_type,omitempty"`
+	// Cohort is the cohort the device was generated for, if any
+	Cohort string   `json:"cohort,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+// assignedKey is a key file picked for a run, with the index of its device
+type assignedKey struct {
+	index int
+	path  string
+}
+
+func (d *fleetDevice) hasTags(tags []string) bool {
+	for _, t := range tags {
+		found := false
+		for _, dt := range d.Tags {
+			if dt == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// indexRange is an inclusive range of device indices
+type indexRange struct {
+	from, to int
+}
+
+// parseIndexRanges parses device indices and ranges of them distinguished
+// with ',', e.g. 0-999,2000,3000-3099
+func parseIndexRanges(s string) ([]indexRange, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var ranges []indexRange
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		from, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, errors.Errorf("invalid device index %q", part)
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+				return nil, errors.Errorf("invalid device range %q", part)
+			}
+		}
+		if from < 0 || to < from {
+			return nil, errors.Errorf("invalid device range %q", part)
+		}
+		ranges = append(ranges, indexRange{from, to})
+	}
+	return ranges, nil
+}
+
+func inRanges(index int, ranges []indexRange) bool {
+	for _, r := range ranges {
+		if index >= r.from && index <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// DeviceSelection picks the devices of a cohort out of the fleet; all of
+// the given criteria have to match
+type DeviceSelection struct {
+	// Devices are index ranges, e.g. 0-999,2000-2099
+	Devices string `json:"devices"`
+	// Cohort is the cohort the devices were generated for
+	Cohort string `json:"cohort"`
+	// Tags the devices have to carry
+	Tags []string `json:"tags"`
+
+	ranges []indexRange
+}
+
+func (s *DeviceSelection) empty() bool {
+	return s == nil || (s.Devices == "" && s.Cohort == "" && len(s.Tags) == 0)
+}
+
+func (s *DeviceSelection) parse() error {
+	if s == nil {
+		return nil
+	}
+	var err error
+	s.ranges, err = parseIndexRanges(s.Devices)
+	return err
+}
+
+func (s *DeviceSelection) matches(d *fleetDevice) bool {
+	return (len(s.ranges) == 0 || inRanges(d.Index, s.ranges)) &&
+		(s.Cohort == "" || d.Cohort == s.Cohort) &&
+		d.hasTags(s.Tags)
+}
+
+// fleet holds the devices whose keys are kept in a key directory
+type fleet struct {
+	dir string
+	// unsaved is set until the fleet has a manifest
+	unsaved bool
+
+	// ShardSize is the number of keys per subdirectory, zero keeps all of
+	// them in the key directory itself
+	ShardSize int            `json:"shard_size"`
+	Devices   []*fleetDevice `json:"devices"`
+}
+
+// openFleet loads the fleet manifest of the key directory; without one the
+// fleet is made up of the key files found in the directory. Keys named
+// after their index keep it, others are numbered after them.
+func openFleet(dir string) (*fleet, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create key directory")
+	}
+	f := &fleet{dir: dir}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, fleetManifestName))
+	if os.IsNotExist(err) {
+		f.unsaved = true
+		var unnumbered []string
+		next := 0
+		for _, key := range listKeyFiles(dir) {
+			name := filepath.Base(key)
+			index, err := strconv.Atoi(strings.TrimSuffix(name, keySuffix))
+			if !strings.HasSuffix(name, keySuffix) || err != nil {
+				unnumbered = append(unnumbered, name)
+				continue
+			}
+			f.Devices = append(f.Devices, &fleetDevice{Index: index, Key: name})
+			if index >= next {
+				next = index + 1
+			}
+		}
+		for i, name := range unnumbered {
+			f.Devices = append(f.Devices, &fleetDevice{Index: next + i, Key: name})
+		}
+		sort.Slice(f.Devices, func(i, j int) bool { return f.Devices[i].Index < f.Devices[j].Index })
+		return f, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read fleet manifest")
+	}
+
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, errors.Wrapf(err, "corrupt fleet manifest in %s", dir)
+	}
+	sort.Slice(f.Devices, func(i, j int) bool { return f.Devices[i].Index < f.Devices[j].Index })
+	return f, nil
+}
+
+func (f *fleet) save() error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(f.dir, fleetManifestName), data, 0600); err != nil {
+		return errors.Wrapf(err, "failed to write fleet manifest")
+	}
+	f.unsaved = false
+	return nil
+}
+
+func (f *fleet) keyFile(d *fleetDevice) string {
+	return filepath.Join(f.dir, d.Key)
+}
+
+// keyName places the key of a new device, sharded by index if configured
+func (f *fleet) keyName(index int) string {
+	name := fmt.Sprintf("%06d%s", index, keySuffix)
+	if f.ShardSize <= 0 {
+		return name
+	}
+	return filepath.Join(fmt.Sprintf("%03d", index/f.ShardSize), name)
+}
+
+// generate adds n devices with new keys of the given type to the fleet,
+// using a pool of workers; their identities come from the template
+func (f *fleet) generate(n int, keyType, cohort string, tags []string, identity IdentityTemplate, workers int) ([]*fleetDevice, error) {
+	next := 0
+	for _, d := range f.Devices {
+		if d.Index >= next {
+			next = d.Index + 1
+		}
+	}
+
+	devices := make([]*fleetDevice, n)
+	for i := range devices {
+		// keys not listed in the manifest are left alone
+		for {
+			if _, err := os.Stat(filepath.Join(f.dir, f.keyName(next))); os.IsNotExist(err) {
+				break
+			}
+			next++
+		}
+		devices[i] = &fleetDevice{
+			Index:   next,
+			Key:     f.keyName(next),
+			KeyType: keyType,
+			Cohort:  cohort,
+			Tags:    tags,
+		}
+		next++
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	work := make(chan *fleetDevice)
+	var done int64
+	var lock sync.Mutex
+	var firstErr error
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range work {
+				path := f.keyFile(d)
+				err := os.MkdirAll(filepath.Dir(path), 0700)
+				if err == nil {
+					err = generateClientKeys(path, keyType)
+				}
+				if err == nil {
+					err = ensureIdentity(path, identity, d.Index)
+				}
+				if err != nil {
+					lock.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					lock.Unlock()
+				}
+				atomic.AddInt64(&done, 1)
+			}
+		}()
+	}
+
+	finished := make(chan struct{})
+	reported := make(chan struct{})
+	go func() {
+		reportKeygenProgress(&done, n, finished)
+		close(reported)
+	}()
+
+	for _, d := range devices {
+		work <- d
+	}
+	close(work)
+	wg.Wait()
+	close(finished)
+	<-reported
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	f.Devices = append(f.Devices, devices...)
+	return devices, nil
+}
+
+// check loads the key of every device of the fleet with a pool of workers,
+// reporting the unusable ones, and records the type of keys missing from
+// the manifest. It returns the number of unusable keys.
+func (f *fleet) check(workers int) int {
+	if workers < 1 {
+		workers = 1
+	}
+	work := make(chan *fleetDevice)
+	var invalid, typed int64
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range work {
+				key, err := loadDeviceKey(f.keyFile(d))
+				if err != nil {
+					log.Errorf("device %d: %v", d.Index, err)
+					atomic.AddInt64(&invalid, 1)
+					continue
+				}
+				if d.KeyType == "" {
+					d.KeyType = key.keyType()
+					atomic.AddInt64(&typed, 1)
+				}
+			}
+		}()
+	}
+	for _, d := range f.Devices {
+		work <- d
+	}
+	close(work)
+	wg.Wait()
+
+	if typed > 0 {
+		f.unsaved = true
+	}
+	if invalid > 0 {
+		log.Errorf("%d of the %d keys in %s are unusable", invalid, len(f.Devices), f.dir)
+	}
+	return int(invalid)
+}
+
+func reportKeygenProgress(done *int64, total int, finished <-chan struct{}) {
+	start := time.Now()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n := atomic.LoadInt64(done)
+			rate := float64(n) / time.Since(start).Seconds()
+			eta := "-"
+			if rate > 0 {
+				eta = (time.Duration(float64(int64(total)-n)/rate) * time.Second).Round(time.Second).String()
+			}
+			fmt.Printf("generated %d/%d keys (%.1f/s, %s left)\n", n, total, rate, eta)
+		case <-finished:
+			fmt.Printf("generated %d keys in %v\n", total, time.Since(start).Round(time.Second))
+			return
+		}
+	}
+}
+
+// assign picks the key files of the devices of every cohort, only taking
+// keys of the key type of the cohort. A cohort with a device selection gets
+// the devices matching it. Otherwise devices generated for a cohort go to
+// the cohort of that name first, the rest are filled up with devices not
+// generated for any of the cohorts, and missing devices are generated. All
+// picked keys are checked to be loadable.
+func (f *fleet) assign(cohorts []*Cohort, workers int) ([][]assignedKey, error) {
+	names := make(map[string]bool)
+	for _, c := range cohorts {
+		names[c.Name] = true
+	}
+
+	used := make(map[*fleetDevice]bool)
+	picked := make([][]*fleetDevice, len(cohorts))
+	take := func(i int, match func(*fleetDevice) bool) {
+		for _, d := range f.Devices {
+			if len(picked[i]) == cohorts[i].Count {
+				return
+			}
+			if !used[d] && match(d) && f.hasKeyType(d, cohorts[i].KeyType) {
+				used[d] = true
+				picked[i] = append(picked[i], d)
+			}
+		}
+	}
+
+	// explicit selections go first, so the other cohorts do not take
+	// their devices
+	for i, c := range cohorts {
+		if !c.Select.empty() {
+			take(i, c.Select.matches)
+			if len(picked[i]) < c.Count {
+				return nil, errors.Errorf(
+					"cohort %s needs %d devices with %s keys, its selection matches only %d unused ones",
+					c.Name, c.Count, c.KeyType, len(picked[i]))
+			}
+		}
+	}
+	for i, c := range cohorts {
+		name := c.Name
+		take(i, func(d *fleetDevice) bool { return d.Cohort == name })
+	}
+	for i := range cohorts {
+		take(i, func(d *fleetDevice) bool { return !names[d.Cohort] })
+	}
+
+	for i, c := range cohorts {
+		if missing := c.Count - len(picked[i]); missing > 0 {
+			fmt.Printf("%d keys need to be generated for cohort %s..\n", missing, c.Name)
+			devices, err := f.generate(missing, c.KeyType, c.Name, nil, c.Identity, workers)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to generate crypto keys")
+			}
+			picked[i] = append(picked[i], devices...)
+			f.unsaved = true
+		}
+	}
+
+	keys := make([][]assignedKey, len(cohorts))
+	invalid := 0
+	for i, c := range cohorts {
+		for _, d := range picked[i] {
+			path := f.keyFile(d)
+			if _, err := loadDeviceKey(path); err != nil {
+				log.Errorf("device %d: %v", d.Index, err)
+				invalid++
+				continue
+			}
+			if err := ensureIdentity(path, c.Identity, d.Index); err != nil {
+				return nil, err
+			}
+			keys[i] = append(keys[i], assignedKey{index: d.Index, path: path})
+		}
+	}
+	if invalid > 0 {
+		return nil, errors.Errorf("%d unusable device keys", invalid)
+	}
+
+	if f.unsaved {
+		if err := f.save(); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// hasKeyType tells whether the key of the device is of the given type. The
+// type of keys missing from the manifest, e.g. of older versions, is looked
+// up in the key itself and recorded; unloadable keys match any type, so they
+// are reported once picked.
+func (f *fleet) hasKeyType(d *fleetDevice, keyType string) bool {
+	if d.KeyType == "" {
+		key, err := loadDeviceKey(f.keyFile(d))
+		if err != nil {
+			return true
+		}
+		d.KeyType = key.keyType()
+		f.unsaved = true
+	}
+	return d.KeyType == keyType
+}
+
+// splitList splits a list distinguished with ',', dropping empty entries
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
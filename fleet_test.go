@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseIndexRanges(t *testing.T) {
+	tests := []struct {
+		ranges string
+		want   []indexRange
+		err    bool
+	}{
+		{ranges: "", want: nil},
+		{ranges: " ", want: nil},
+		{ranges: "7", want: []indexRange{{7, 7}}},
+		{ranges: "0-999,2000,3000-3099", want: []indexRange{{0, 999}, {2000, 2000}, {3000, 3099}}},
+		{ranges: "0-9, 20 - 29", want: []indexRange{{0, 9}, {20, 29}}},
+		{ranges: "9-0", err: true},
+		{ranges: "-1", err: true},
+		{ranges: "a-b", err: true},
+		{ranges: "0-", err: true},
+	}
+	for _, test := range tests {
+		ranges, err := parseIndexRanges(test.ranges)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.ranges, ranges)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.ranges, err)
+			continue
+		}
+		if !reflect.DeepEqual(ranges, test.want) {
+			t.Errorf("%q: got %v, want %v", test.ranges, ranges, test.want)
+		}
+	}
+}
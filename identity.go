@@ -0,0 +1,201 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// key files are named after the device index, the identity of the device is
+// kept in a file of the same name next to it
+const (
+	keySuffix      = ".key"
+	identitySuffix = ".identity"
+)
+
+// IdentityTemplate maps identity attribute names to templates of their
+// values. Templates are literal text with these placeholders:
+//
+//	{seq} or {seq:N}  the device index, zero padded to N digits
+//	{uuid}            a random UUID
+//	{mac}             a random MAC address
+//	{hex:N}           N random hex digits
+type IdentityTemplate map[string]string
+
+var identityPlaceholder = regexp.MustCompile(`\{(\w+)(?::(\d+))?\}`)
+
+// parseIdentityTemplate parses name=template pairs distinguished with ','
+func parseIdentityTemplate(s string) (IdentityTemplate, error) {
+	t := make(IdentityTemplate)
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, errors.Errorf("invalid identity attribute %q, expected name=template", pair)
+		}
+		t[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return t, t.validate()
+}
+
+func (t IdentityTemplate) validate() error {
+	if len(t) == 0 {
+		return errors.New("identity template has no attributes")
+	}
+	for name, tmpl := range t {
+		for _, m := range identityPlaceholder.FindAllStringSubmatch(tmpl, -1) {
+			switch m[1] {
+			case "seq", "uuid", "mac":
+			case "hex":
+				if m[2] == "" {
+					return errors.Errorf("identity attribute %s: {hex} needs a length, e.g. {hex:8}", name)
+				}
+			default:
+				return errors.Errorf("identity attribute %s: unknown placeholder %s", name, m[0])
+			}
+		}
+	}
+	return nil
+}
+
+// generate fills in the templates for the device with the given index; the
+// random values come from rnd
+func (t IdentityTemplate) generate(index int, rnd *mrand.Rand) map[string]string {
+	// go through the attributes in a fixed order, so that a seeded rnd
+	// always gives the same identity
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	identity := make(map[string]string, len(t))
+	for _, name := range names {
+		identity[name] = identityPlaceholder.ReplaceAllStringFunc(t[name], func(p string) string {
+			m := identityPlaceholder.FindStringSubmatch(p)
+			width, _ := strconv.Atoi(m[2])
+			switch m[1] {
+			case "seq":
+				return fmt.Sprintf("%0*d", width, index)
+			case "uuid":
+				b := randomBytes(rnd, 16)
+				b[6] = b[6]&0x0f | 0x40
+				b[8] = b[8]&0x3f | 0x80
+				return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+			case "mac":
+				b := randomBytes(rnd, 6)
+				return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", b[0], b[1], b[2], b[3], b[4], b[5])
+			case "hex":
+				return fmt.Sprintf("%x", randomBytes(rnd, (width+1)/2))[:width]
+			}
+			return p
+		})
+	}
+	return identity
+}
+
+func randomBytes(rnd *mrand.Rand, n int) []byte {
+	b := make([]byte, n)
+	rnd.Read(b)
+	return b
+}
+
+// identityRand returns the source of the random identity values of a
+// device; with a non-zero seed they are derived from the seed and the device
+// index, hashed together so that neighbouring seeds do not share identities
+func identityRand(seed int64, index int) *mrand.Rand {
+	if seed == 0 {
+		return mrand.New(cryptoSource{})
+	}
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(seed))
+	binary.BigEndian.PutUint64(b[8:], uint64(index))
+	h := fnv.New64a()
+	h.Write(b[:])
+	return mrand.New(mrand.NewSource(int64(h.Sum64())))
+}
+
+// cryptoSource draws from crypto/rand, so that identities of unseeded runs
+// do not repeat
+type cryptoSource struct{}
+
+func (cryptoSource) Int63() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return int64(binary.BigEndian.Uint64(b[:]) &^ (1 << 63))
+}
+
+func (cryptoSource) Seed(int64) {}
+
+func identityFile(keyFile string) string {
+	return strings.TrimSuffix(keyFile, keySuffix) + identitySuffix
+}
+
+// ensureIdentity generates the identity of the device owning the key file,
+// unless it already has one
+func ensureIdentity(keyFile string, t IdentityTemplate, index int) error {
+	if !strings.HasSuffix(keyFile, keySuffix) {
+		return nil
+	}
+	path := identityFile(keyFile)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	data, _ := json.Marshal(t.generate(index, identityRand(identitySeed, index)))
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return errors.Wrapf(err, "failed to save identity of %s", keyFile)
+	}
+	return nil
+}
+
+// loadIdentity returns the identity data of the device owning the key file;
+// key files of older versions are named after the MAC address of the device
+func loadIdentity(keyFile string) (map[string]string, error) {
+	if !strings.HasSuffix(keyFile, keySuffix) {
+		return map[string]string{"mac": filepath.Base(keyFile)}, nil
+	}
+
+	data, err := ioutil.ReadFile(identityFile(keyFile))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read identity of %s", keyFile)
+	}
+	var identity map[string]string
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return nil, errors.Wrapf(err, "corrupt identity of %s", keyFile)
+	}
+	return identity, nil
+}
+
+// key files of older versions are named after the MAC address of the device
+var legacyKeyName = regexp.MustCompile(`^([0-9a-f]{2}:){5}[0-9a-f]{2}$`)
+
+// listKeyFiles returns the device key files directly in dir; other files
+// are ignored
+func listKeyFiles(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	keys := files[:0]
+	for _, f := range files {
+		name := filepath.Base(f)
+		if !strings.HasSuffix(name, keySuffix) && !legacyKeyName.MatchString(name) {
+			continue
+		}
+		if info, err := os.Stat(f); err == nil && info.Mode().IsRegular() {
+			keys = append(keys, f)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+	mrand "math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// kinds of generated inventory values
+const (
+	// one of the choices
+	invChoice = "choice"
+	// a whole or a decimal number between min and max
+	invInt   = "int"
+	invFloat = "float"
+	// an address in the subnet, 10.0.0.0/8 by default
+	invIPv4 = "ipv4"
+	invMAC  = "mac"
+	// a latitude,longitude pair
+	invGeo = "geo"
+	// an identity template, e.g. device-{seq:6}
+	invTemplate = "template"
+)
+
+// name of the built in inventory model
+const inventoryRealistic = "realistic"
+
+// inventory policies
+const (
+	// submit the inventory every inventory interval (default)
+	invPolicyPeriodic = "periodic"
+	// like the real client: submit after authenticating and after a
+	// successful update, and then every inventory interval with jitter
+	invPolicyRealistic = "realistic"
+	// like realistic, but only submit when the inventory changed
+	invPolicyDiff = "diff"
+)
+
+// share of the inventory interval it is varied by at least in the
+// realistic and diff policies
+const inventoryJitter = 0.2
+
+func validInventoryPolicy(policy string) bool {
+	switch policy {
+	case invPolicyPeriodic, invPolicyRealistic, invPolicyDiff:
+		return true
+	}
+	return false
+}
+
+// inventoryTimerJitter returns the share of the inventory interval it is
+// varied by
+func (c *Cohort) inventoryTimerJitter() float64 {
+	jitter := c.TimerJitter / 100
+	if c.InventoryPolicy != invPolicyPeriodic && jitter < inventoryJitter {
+		jitter = inventoryJitter
+	}
+	return jitter
+}
+
+// InventoryGenerator generates the value of an inventory attribute of every
+// device. Values are static, unless numbers are given a drift or other
+// values a change rate.
+type InventoryGenerator struct {
+	Kind     string   `json:"kind"`
+	Choices  []string `json:"choices,omitempty"`
+	Min      float64  `json:"min,omitempty"`
+	Max      float64  `json:"max,omitempty"`
+	Subnet   string   `json:"subnet,omitempty"`
+	Template string   `json:"template,omitempty"`
+	// Count makes the attribute a list of that many values
+	Count int `json:"count,omitempty"`
+	// Drift is the largest step a number moves by between two inventory
+	// submits, staying between min and max
+	Drift float64 `json:"drift,omitempty"`
+	// ChangeRate is the probability of any other value being generated
+	// anew before an inventory submit
+	ChangeRate float64 `json:"change_rate,omitempty"`
+
+	subnet *net.IPNet
+}
+
+func (g *InventoryGenerator) validate() error {
+	switch g.Kind {
+	case invChoice:
+		if len(g.Choices) == 0 {
+			return errors.New("choice needs choices")
+		}
+	case invInt, invFloat:
+		if g.Max < g.Min {
+			return errors.New("max is less than min")
+		}
+	case invIPv4:
+		subnet := g.Subnet
+		if subnet == "" {
+			subnet = "10.0.0.0/8"
+		}
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil || ipnet.IP.To4() == nil {
+			return errors.Errorf("invalid IPv4 subnet %q", g.Subnet)
+		}
+		g.subnet = ipnet
+	case invMAC, invGeo:
+	case invTemplate:
+		if err := (IdentityTemplate{"template": g.Template}).validate(); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("unknown kind %q", g.Kind)
+	}
+	if g.Count < 0 || g.Drift < 0 || g.ChangeRate < 0 || g.ChangeRate > 1 {
+		return errors.New("count, drift and change_rate must not be negative, change_rate at most 1")
+	}
+	return nil
+}
+
+// generate returns a new value for the device with the given index
+func (g *InventoryGenerator) generate(index int, rnd *mrand.Rand) interface{} {
+	if g.Count == 0 {
+		return g.generateOne(index, rnd)
+	}
+	values := make([]interface{}, g.Count)
+	if g.Kind == invChoice && g.Count <= len(g.Choices) {
+		// lists of choices do not repeat themselves
+		for i, c := range rnd.Perm(len(g.Choices))[:g.Count] {
+			values[i] = g.Choices[c]
+		}
+		return values
+	}
+	for i := range values {
+		values[i] = g.generateOne(index, rnd)
+	}
+	return values
+}
+
+func (g *InventoryGenerator) generateOne(index int, rnd *mrand.Rand) interface{} {
+	switch g.Kind {
+	case invChoice:
+		return g.Choices[rnd.Intn(len(g.Choices))]
+	case invInt:
+		return int64(g.Min) + rnd.Int63n(int64(g.Max)-int64(g.Min)+1)
+	case invFloat:
+		return round1(g.Min + rnd.Float64()*(g.Max-g.Min))
+	case invIPv4:
+		ip := make(net.IP, 4)
+		copy(ip, g.subnet.IP.To4())
+		host := randomBytes(rnd, 4)
+		for i := range ip {
+			ip[i] |= host[i] &^ g.subnet.Mask[i]
+		}
+		return ip.String()
+	case invMAC:
+		b := randomBytes(rnd, 6)
+		// locally administered unicast
+		b[0] = b[0]&0xfc | 0x02
+		return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", b[0], b[1], b[2], b[3], b[4], b[5])
+	case invGeo:
+		return fmt.Sprintf("%.4f,%.4f", rnd.Float64()*120-55, rnd.Float64()*360-180)
+	case invTemplate:
+		return IdentityTemplate{"value": g.Template}.generate(index, rnd)["value"]
+	}
+	return nil
+}
+
+// next returns the value following the current one on the next submit
+func (g *InventoryGenerator) next(value interface{}, index int, rnd *mrand.Rand) interface{} {
+	if g.Drift > 0 && (g.Kind == invInt || g.Kind == invFloat) {
+		if values, ok := value.([]interface{}); ok {
+			drifted := make([]interface{}, len(values))
+			for i, v := range values {
+				drifted[i] = g.drift(v, rnd)
+			}
+			return drifted
+		}
+		return g.drift(value, rnd)
+	}
+	if g.ChangeRate > 0 && rnd.Float64() < g.ChangeRate {
+		return g.generate(index, rnd)
+	}
+	return value
+}
+
+func (g *InventoryGenerator) drift(value interface{}, rnd *mrand.Rand) interface{} {
+	step := (rnd.Float64()*2 - 1) * g.Drift
+	switch v := value.(type) {
+	case int64:
+		return int64(math.Max(g.Min, math.Min(g.Max, math.Round(float64(v)+step))))
+	case float64:
+		return round1(math.Max(g.Min, math.Min(g.Max, v+step)))
+	}
+	return value
+}
+
+func round1(f float64) float64 {
+	return math.Round(f*10) / 10
+}
+
+// InventoryModel maps inventory attribute names to the generators of their
+// values. In a scenario it is given either as an object or as the name of
+// the built in model or of a JSON file holding one.
+type InventoryModel map[string]*InventoryGenerator
+
+// realisticInventory is the built in model, resembling what the inventory
+// scripts of the real client report
+func realisticInventory() InventoryModel {
+	return InventoryModel{
+		"kernel": {Kind: invChoice, Choices: []string{
+			"Linux version 4.14.98-v7+", "Linux version 4.19.118-v7l+",
+			"Linux version 5.4.83-v7l+", "Linux version 5.10.63-v8+",
+			"Linux version 5.15.61-v8+", "Linux version 6.1.21-v8+",
+		}},
+		"hostname":           {Kind: invTemplate, Template: "device-{seq:6}"},
+		"cpu_model":          {Kind: invChoice, Choices: []string{"ARMv7 Processor rev 3 (v7l)", "ARMv7 Processor rev 4 (v7l)", "Cortex-A53", "Cortex-A72", "Intel(R) Atom(TM) CPU E3845"}},
+		"mem_total_kB":       {Kind: invChoice, Choices: []string{"492424", "948304", "1917292", "3930860", "8007336"}},
+		"network_interfaces": {Kind: invChoice, Choices: []string{"eth0", "wlan0", "usb0"}, Count: 2},
+		"ipv4_eth0":          {Kind: invIPv4, Subnet: "10.0.0.0/8", ChangeRate: 0.02},
+		"ipv4_wlan0":         {Kind: invIPv4, Subnet: "192.168.0.0/16", ChangeRate: 0.05},
+		"mac_eth0":           {Kind: invMAC},
+		"mac_wlan0":          {Kind: invMAC},
+		"rootfs_usage":       {Kind: invInt, Min: 5, Max: 98, Drift: 1},
+		"cpu_temperature":    {Kind: invFloat, Min: 30, Max: 85, Drift: 2},
+		"uptime_hours":       {Kind: invInt, Min: 0, Max: 8760, Drift: 3},
+		"geo_location":       {Kind: invGeo},
+	}
+}
+
+// loadInventoryModel returns the built in model or reads one from a JSON
+// file; empty gives no model
+func loadInventoryModel(spec string) (InventoryModel, error) {
+	switch spec {
+	case "":
+		return nil, nil
+	case inventoryRealistic:
+		m := realisticInventory()
+		return m, m.validate()
+	}
+
+	data, err := ioutil.ReadFile(spec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read inventory model")
+	}
+	var m map[string]*InventoryGenerator
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse inventory model %s", spec)
+	}
+	return m, InventoryModel(m).validate()
+}
+
+func (m *InventoryModel) UnmarshalJSON(data []byte) error {
+	var spec string
+	if err := json.Unmarshal(data, &spec); err == nil {
+		loaded, err := loadInventoryModel(spec)
+		*m = loaded
+		return err
+	}
+	var generators map[string]*InventoryGenerator
+	if err := json.Unmarshal(data, &generators); err != nil {
+		return err
+	}
+	*m = generators
+	return nil
+}
+
+func (m InventoryModel) validate() error {
+	for name, g := range m {
+		if g == nil {
+			return errors.Errorf("inventory attribute %s: no generator", name)
+		}
+		if err := g.validate(); err != nil {
+			return errors.Wrapf(err, "inventory attribute %s", name)
+		}
+	}
+	return nil
+}
+
+func (m InventoryModel) names() []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deviceInventory holds the generated inventory values of a device; the
+// values are drawn from a source seeded with the device name, so that a
+// device reports the same inventory, and drifts the same way, in every run.
+// Sequential values follow the index of the device in the fleet.
+type deviceInventory struct {
+	model  InventoryModel
+	index  int
+	rnd    *mrand.Rand
+	values map[string]interface{}
+}
+
+func newDeviceInventory(model InventoryModel, name string, index int) *deviceInventory {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+
+	inv := &deviceInventory{
+		model:  model,
+		index:  index,
+		rnd:    mrand.New(mrand.NewSource(int64(h.Sum64()) + inventorySeed)),
+		values: make(map[string]interface{}, len(model)),
+	}
+	// go through the attributes in a fixed order to keep the values
+	// reproducible
+	for _, name := range model.names() {
+		inv.values[name] = model[name].generate(index, inv.rnd)
+	}
+	return inv
+}
+
+// attributes returns the current values, and moves the drifting ones on
+// for the next submit
+func (inv *deviceInventory) attributes() []client.InventoryAttribute {
+	var attrs []client.InventoryAttribute
+	for _, name := range inv.model.names() {
+		attrs = append(attrs, client.InventoryAttribute{Name: name, Value: inv.values[name]})
+		inv.values[name] = inv.model[name].next(inv.values[name], inv.index, inv.rnd)
+	}
+	return attrs
+}
+
+// parseInventoryItems parses the static inventory attributes of a cohort,
+// given in one of these formats:
+//
+//	name=value pairs distinguished with ','; values are numbers, true or
+//	false, JSON arrays or strings, "quoted" to keep them strings or to
+//	contain ',' (with Go escapes)
+//	name:value pairs of older versions, all values are strings
+//	a JSON object mapping names to values
+//	@file holding one of the above, pairs may be given one per line and
+//	lines starting with '#' are skipped
+func parseInventoryItems(items string) ([]client.InventoryAttribute, error) {
+	items = strings.TrimSpace(items)
+	if strings.HasPrefix(items, "@") {
+		data, err := ioutil.ReadFile(items[1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read inventory")
+		}
+		var lines []string
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				lines = append(lines, line)
+			}
+		}
+		items = strings.Join(lines, ",")
+		if strings.HasPrefix(items, "{") {
+			items = strings.Join(lines, "\n")
+		}
+	}
+
+	if strings.HasPrefix(items, "{") {
+		var values map[string]interface{}
+		if err := json.Unmarshal([]byte(items), &values); err != nil {
+			return nil, errors.Wrapf(err, "invalid JSON inventory")
+		}
+		attrs := make([]client.InventoryAttribute, 0, len(values))
+		for name, value := range values {
+			attrs = append(attrs, client.InventoryAttribute{Name: name, Value: value})
+		}
+		sort.Slice(attrs, func(i, j int) bool { return attrs[i].Name < attrs[j].Name })
+		return attrs, nil
+	}
+
+	pairs, err := splitInventoryPairs(items)
+	if err != nil {
+		return nil, err
+	}
+	var attrs []client.InventoryAttribute
+	seen := make(map[string]bool)
+	for _, pair := range pairs {
+		attr, err := parseInventoryPair(pair)
+		if err != nil {
+			return nil, err
+		}
+		if seen[attr.Name] {
+			return nil, errors.Errorf("inventory attribute %s given twice", attr.Name)
+		}
+		seen[attr.Name] = true
+		attrs = append(attrs, attr)
+	}
+	return attrs, nil
+}
+
+// splitInventoryPairs splits the pairs at the ',' outside of quotes and
+// brackets; empty pairs are dropped
+func splitInventoryPairs(items string) ([]string, error) {
+	var pairs []string
+	var quoted, escaped bool
+	depth, start := 0, 0
+	for i, r := range items {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case quoted:
+		case r == '[':
+			depth++
+		case r == ']':
+			depth--
+		case r == ',' && depth == 0:
+			pairs = append(pairs, items[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, errors.Errorf("unterminated quote in inventory %q", items)
+	}
+	if depth != 0 {
+		return nil, errors.Errorf("unbalanced brackets in inventory %q", items)
+	}
+	pairs = append(pairs, items[start:])
+
+	nonEmpty := pairs[:0]
+	for _, p := range pairs {
+		if strings.TrimSpace(p) != "" {
+			nonEmpty = append(nonEmpty, p)
+		}
+	}
+	return nonEmpty, nil
+}
+
+func parseInventoryPair(pair string) (client.InventoryAttribute, error) {
+	i, colon := strings.Index(pair, "="), strings.Index(pair, ":")
+	if i >= 0 && (colon < 0 || i < colon) {
+		name := strings.TrimSpace(pair[:i])
+		if name == "" {
+			return client.InventoryAttribute{}, errors.Errorf("invalid inventory attribute %q, name is empty", pair)
+		}
+		value, err := parseInventoryValue(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			return client.InventoryAttribute{}, errors.Wrapf(err, "inventory attribute %s", name)
+		}
+		return client.InventoryAttribute{Name: name, Value: value}, nil
+	}
+
+	// name:value pairs of older versions; the value runs up to the end, so
+	// it may contain ':' itself
+	kv := strings.SplitN(pair, ":", 2)
+	if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+		return client.InventoryAttribute{}, errors.Errorf("invalid inventory attribute %q, expected name=value", pair)
+	}
+	return client.InventoryAttribute{Name: strings.TrimSpace(kv[0]), Value: strings.TrimSpace(kv[1])}, nil
+}
+
+func parseInventoryValue(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		value, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, errors.Errorf("invalid quoted value %s", s)
+		}
+		return value, nil
+	case strings.HasPrefix(s, "["):
+		var values []interface{}
+		if err := json.Unmarshal([]byte(s), &values); err != nil {
+			return nil, errors.Errorf("invalid array %s, expected a JSON array", s)
+		}
+		return values, nil
+	case s == "true" || s == "false":
+		return s == "true", nil
+	}
+	// only values that read back the same are numbers, e.g. not 007 or 1.10
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(i, 10) == s {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) &&
+		strconv.FormatFloat(f, 'f', -1, 64) == s {
+		return f, nil
+	}
+	return s, nil
+}
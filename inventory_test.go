@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+)
+
+func TestSplitInventoryPairs(t *testing.T) {
+	tests := []struct {
+		items string
+		pairs []string
+		err   bool
+	}{
+		{items: "", pairs: []string{}},
+		{items: "a=1", pairs: []string{"a=1"}},
+		{items: "a=1,b=2", pairs: []string{"a=1", "b=2"}},
+		{items: "a=1,,b=2,", pairs: []string{"a=1", "b=2"}},
+		{items: `a="x,y",b=2`, pairs: []string{`a="x,y"`, "b=2"}},
+		{items: `a="say \"hi, there\"",b=2`, pairs: []string{`a="say \"hi, there\""`, "b=2"}},
+		{items: "ports=[80,443],b=2", pairs: []string{"ports=[80,443]", "b=2"}},
+		{items: "nested=[[1,2],[3]],b=2", pairs: []string{"nested=[[1,2],[3]]", "b=2"}},
+		{items: `a=["x,y","z"]`, pairs: []string{`a=["x,y","z"]`}},
+		{items: `a="open`, err: true},
+		{items: "a=[1,2", err: true},
+		{items: "a=1]", err: true},
+	}
+	for _, test := range tests {
+		pairs, err := splitInventoryPairs(test.items)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", test.items, pairs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.items, err)
+			continue
+		}
+		if !reflect.DeepEqual(pairs, test.pairs) {
+			t.Errorf("%q: got %q, want %q", test.items, pairs, test.pairs)
+		}
+	}
+}
+
+func TestParseInventoryItems(t *testing.T) {
+	attrs := func(pairs ...interface{}) []client.InventoryAttribute {
+		var a []client.InventoryAttribute
+		for i := 0; i < len(pairs); i += 2 {
+			a = append(a, client.InventoryAttribute{Name: pairs[i].(string), Value: pairs[i+1]})
+		}
+		return a
+	}
+
+	tests := []struct {
+		items string
+		attrs []client.InventoryAttribute
+		err   bool
+	}{
+		{items: "rack=12", attrs: attrs("rack", int64(12))},
+		{items: "temp=-3", attrs: attrs("temp", int64(-3))},
+		{items: "load=0.5", attrs: attrs("load", 0.5)},
+		{items: "beta=true,alpha=false", attrs: attrs("beta", true, "alpha", false)},
+		{items: "image_id=test", attrs: attrs("image_id", "test")},
+		// numbers that would not read back the same stay strings
+		{items: "serial=007", attrs: attrs("serial", "007")},
+		{items: "version=1.10", attrs: attrs("version", "1.10")},
+		{items: "big=1e3", attrs: attrs("big", "1e3")},
+		{items: "plus=+5", attrs: attrs("plus", "+5")},
+		{items: "half=.5", attrs: attrs("half", ".5")},
+		{items: "inf=+Inf,nan=NaN", attrs: attrs("inf", "+Inf", "nan", "NaN")},
+		{items: `rack="12"`, attrs: attrs("rack", "12")},
+		{items: `url="http://example.com/a,b"`, attrs: attrs("url", "http://example.com/a,b")},
+		{items: "ports=[80,443]", attrs: attrs("ports", []interface{}{80.0, 443.0})},
+		{items: " name = spaced ", attrs: attrs("name", "spaced")},
+		{items: "empty=", attrs: attrs("empty", "")},
+		// name:value pairs of older versions
+		{items: "device_type:test,url:http://x:80", attrs: attrs("device_type", "test", "url", "http://x:80")},
+		{items: "rack:12", attrs: attrs("rack", "12")},
+		// '=' before any ':' makes a name=value pair
+		{items: "time=12:30", attrs: attrs("time", "12:30")},
+		{items: `{"rack": 12, "beta": true, "name": "x"}`, attrs: attrs("beta", true, "name", "x", "rack", 12.0)},
+		{items: "a=1,a=2", err: true},
+		{items: "=1", err: true},
+		{items: "noseparator", err: true},
+		{items: `a="unterminated`, err: true},
+		{items: "a=[1,", err: true},
+		{items: `a="bad \q escape"`, err: true},
+		{items: "{not json", err: true},
+	}
+	for _, test := range tests {
+		got, err := parseInventoryItems(test.items)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.items, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.items, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.attrs) {
+			t.Errorf("%q: got %#v, want %#v", test.items, got, test.attrs)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+
+	"github.com/mendersoftware/log"
+)
+
+// runKeygen generates device keys ahead of a run
+func runKeygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	dir := fs.String("dir", "keys", "key directory to add the devices to")
+	count := fs.Int("count", 100, "number of devices to generate")
+	keyType := fs.String("key-type", keyRSA3072, "algorithm of the device keys: rsa2048, rsa3072, rsa4096, ecdsa-p256, ecdsa-p384 or ed25519")
+	cohort := fs.String("cohort", "", "cohort the devices are generated for; runs give them to the scenario cohort of that name")
+	tags := fs.String("tags", "", "tags to give the devices, distinguished with ','")
+	identity := fs.String("identity", "mac={mac}", "identity attributes as name=template pairs distinguished with ','")
+	fs.Int64Var(&identitySeed, "identity-seed", 0, "derive random identity values from this seed and the device index instead of at random (0 disables)")
+	workers := fs.Int("workers", runtime.NumCPU(), "number of keys generated in parallel")
+	shardSize := fs.Int("shard-size", 1000, "number of keys per subdirectory of the key directory (0 keeps them all in one directory)")
+	fs.Parse(args)
+
+	if !validKeyType(*keyType) {
+		log.Fatalf("unknown key type %q", *keyType)
+	}
+	template, err := parseIdentityTemplate(*identity)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := openFleet(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the layout of an existing fleet is kept
+	if len(f.Devices) == 0 {
+		f.ShardSize = *shardSize
+	}
+	f.check(*workers)
+
+	if _, err := f.generate(*count, *keyType, *cohort, splitList(*tags), template, *workers); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.save(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%d devices in %s\n", len(f.Devices), *dir)
+}
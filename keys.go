@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// device key algorithms
+const (
+	keyRSA2048   = "rsa2048"
+	keyRSA3072   = "rsa3072"
+	keyRSA4096   = "rsa4096"
+	keyECDSAP256 = "ecdsa-p256"
+	keyECDSAP384 = "ecdsa-p384"
+	keyEd25519   = "ed25519"
+)
+
+func validKeyType(keyType string) bool {
+	switch keyType {
+	case keyRSA2048, keyRSA3072, keyRSA4096, keyECDSAP256, keyECDSAP384, keyEd25519:
+		return true
+	}
+	return false
+}
+
+// deviceKey is the private key a device signs its authorization requests
+// with. RSA keys are stored as PKCS#1 like the store.Keystore of the client
+// does, ECDSA and Ed25519 keys as PKCS#8.
+type deviceKey struct {
+	signer crypto.Signer
+}
+
+func generateDeviceKey(keyType string) (*deviceKey, error) {
+	var signer crypto.Signer
+	var err error
+
+	switch keyType {
+	case keyRSA2048:
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	case keyRSA3072:
+		signer, err = rsa.GenerateKey(rand.Reader, 3072)
+	case keyRSA4096:
+		signer, err = rsa.GenerateKey(rand.Reader, 4096)
+	case keyECDSAP256:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case keyECDSAP384:
+		signer, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case keyEd25519:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, errors.Errorf("unknown key type %q", keyType)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to generate %s key", keyType)
+	}
+	return &deviceKey{signer: signer}, nil
+}
+
+func loadDeviceKey(path string) (*deviceKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read key")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf("no PEM data in key %s", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse key %s", path)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("unsupported key type %T in %s", key, path)
+	}
+	return &deviceKey{signer: signer}, nil
+}
+
+// keyType returns the algorithm of the key, empty if it is none of the
+// supported ones
+func (k *deviceKey) keyType() string {
+	switch key := k.signer.(type) {
+	case *rsa.PrivateKey:
+		switch key.N.BitLen() {
+		case 2048:
+			return keyRSA2048
+		case 3072:
+			return keyRSA3072
+		case 4096:
+			return keyRSA4096
+		}
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return keyECDSAP256
+		case elliptic.P384():
+			return keyECDSAP384
+		}
+	case ed25519.PrivateKey:
+		return keyEd25519
+	}
+	return ""
+}
+
+func (k *deviceKey) save(path string) error {
+	var block *pem.Block
+	if rsaKey, ok := k.signer.(*rsa.PrivateKey); ok {
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}
+	} else {
+		data, err := x509.MarshalPKCS8PrivateKey(k.signer)
+		if err != nil {
+			return errors.Wrapf(err, "failed to marshal key")
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: data}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pem.Encode(f, block)
+}
+
+func (k *deviceKey) PublicPEM() (string, error) {
+	data, err := x509.MarshalPKIXPublicKey(k.signer.Public())
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to marshal public key")
+	}
+
+	buf := &bytes.Buffer{}
+	if err := pem.Encode(buf, &pem.Block{Type: "PUBLIC KEY", Bytes: data}); err != nil {
+		return "", errors.Wrapf(err, "failed to encode public key to PEM")
+	}
+	return buf.String(), nil
+}
+
+// Sign signs the SHA256 digest of the data with RSA (PKCS#1 v1.5) and ECDSA
+// (ASN.1 encoded) keys, and the data itself with Ed25519 keys
+func (k *deviceKey) Sign(data []byte) ([]byte, error) {
+	if _, ok := k.signer.(ed25519.PrivateKey); ok {
+		return k.signer.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	sum := sha256.Sum256(data)
+	return k.signer.Sign(rand.Reader, sum[:], crypto.SHA256)
+}
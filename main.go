@@ -1,24 +1,21 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/tls"
 	"encoding/json"
 	"flag"
-	"fmt"
 	"io"
 	"io/ioutil"
 	mrand "math/rand"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"runtime"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
-	"github.com/mendersoftware/mender/store"
 )
 
 var (
@@ -34,20 +31,63 @@ var (
 	currentDeviceType        string
 	debugMode                bool
 	substateReporting        bool
-
-	updatesPerformed  int
-	updatesLeftToFail int
+	metricsAddr              string
+	scenarioFile             string
+	arrivalModel             string
+	arrivalDuration          int
+	arrivalRate              float64
+	arrivalSteps             string
+	runDuration              int
+	reportFile               string
+	stateDir                 string
+	downloadMode             string
+	downloadRate             string
+	fleetDownloadRate        string
+	faultLatency             time.Duration
+	faultJitter              time.Duration
+	faultResetRate           float64
+	faultPartialUploadRate   float64
+	faultPartialBodyRate     float64
+	faultDNSRate             float64
+	faultTimeoutRate         float64
+	faultTimeout             time.Duration
+	retryProfile             string
+	retryMaxInterval         time.Duration
+	preauthManifest          string
+	preauthPush              bool
+	managementToken          string
+	identityTemplate         string
+	identitySeed             int64
+	keyType                  string
+	deviceRanges             string
+	deviceCohort             string
+	deviceTags               string
+	caCert                   string
+	clientCert               string
+	clientKey                string
+	insecureTLS              bool
+	inventoryModel           string
+	inventorySeed            int64
+	inventoryPolicy          string
+	timerMode                string
+	timerJitter              float64
+	controlAddr              string
+	keysDir                  string
+
+	defaultBandwidth    Bandwidth
+	defaultIdentity     IdentityTemplate
+	defaultInventory    InventoryModel
+	defaultSelection    *DeviceSelection
+	defaultArrivalSteps []ArrivalStep
 
 	tenantToken string
-
-	lock sync.Mutex
 )
 
 type FakeMenderAuthManager struct {
 	idSrc       []byte
 	tenantToken string
-	store       store.Store
-	keyStore    *store.Keystore
+	keyStore    *deviceKey
+	device      *fakeDevice
 }
 
 func init() {
@@ -55,25 +95,76 @@ func init() {
 	flag.IntVar(&maxWaitSteps, "wait", 1800, "max. amount of time to wait between update steps: download image, install, reboot, success/failure")
 	flag.IntVar(&inventoryUpdateFrequency, "invfreq", 600, "amount of time to wait between inventory updates")
 	flag.StringVar(&backendHost, "backend", "https://localhost", "entire URI to the backend")
-	flag.StringVar(&inventoryItems, "inventory", "device_type:test,image_id:test,client_version:test", "inventory key:value pairs distinguished with ','")
+	flag.StringVar(&inventoryItems, "inventory", "device_type=test,image_id=test,client_version=test", "inventory name=value pairs distinguished with ',', a JSON object or @file; values may be numbers, true, false, JSON arrays or \"quoted\" strings")
 	flag.StringVar(&updateFailMsg, "fail", strings.Repeat("failed, damn!", 3), "fail update with specified message")
+	flag.StringVar(&inventoryPolicy, "inventory-policy", invPolicyPeriodic, "when devices submit their inventory: periodic (every -invfreq), realistic (after authenticating, after updates and every -invfreq with jitter, like the real client) or diff (realistic, but only if the inventory changed)")
+	flag.StringVar(&inventoryModel, "inventory-model", "", "generate further inventory attributes of every device: realistic or a JSON model file (none if empty)")
+	flag.Int64Var(&inventorySeed, "inventory-seed", 0, "seed the generated inventory values with, on top of the device name")
 	flag.IntVar(&updateFailCount, "failcount", 1, "amount of clients that will fail an update")
 
 	flag.StringVar(&currentArtifact, "current_artifact", "test", "current installed artifact")
 	flag.StringVar(&currentDeviceType, "current_device", "test", "current device type")
 
 	flag.IntVar(&pollFrequency, "pollfreq", 600, "how often to poll the backend")
+	flag.StringVar(&timerMode, "timers", timersDesync, "how the poll and inventory timers of the devices line up: desync (random offset per device) or synchronized (all fire together, in bursts)")
+	flag.Float64Var(&timerJitter, "timer-jitter", 0, "percentage of the poll and inventory intervals every tick is varied by")
 	flag.BoolVar(&debugMode, "debug", true, "debug output")
 
 	flag.BoolVar(&substateReporting, "substate", false, "send substate reporting")
 	flag.StringVar(&tenantToken, "tenant", "", "tenant key for account")
+	flag.StringVar(&metricsAddr, "metrics", "", "address to serve prometheus metrics on, e.g. :9100 (disabled if empty)")
+	flag.StringVar(&controlAddr, "control", "", "address to serve the control API on, e.g. localhost:9200 (disabled if empty)")
+	flag.StringVar(&scenarioFile, "scenario", "", "JSON scenario file describing device cohorts; replaces the per-device flags")
+
+	flag.StringVar(&arrivalModel, "arrival", "none", "how devices first come online: none, linear, rate, poisson or step")
+	flag.IntVar(&arrivalDuration, "arrival-duration", 600, "amount of time to spread device arrivals over with the linear model")
+	flag.Float64Var(&arrivalRate, "arrival-rate", 10, "devices coming online per second with the rate and poisson models")
+	flag.StringVar(&arrivalSteps, "arrival-steps", "", "step schedule as <seconds>:<devices> pairs distinguished with ',', e.g. 0:100,60:500")
+
+	flag.IntVar(&runDuration, "duration", 0, "amount of time to run for before printing the summary report (0 runs until interrupted)")
+	flag.StringVar(&reportFile, "report", "", "write the summary report as JSON to this file")
+	flag.StringVar(&downloadMode, "download", downloadPlain, "how to download artifacts: plain, fetch (resume and size check like the real client) or validate (fetch and verify the artifact)")
+	flag.StringVar(&downloadRate, "download-rate", "", "per device download rate: fixed (512kbit), uniform range (128kbit-2mbit) or normal mean~stddev (512kbit~128kbit); unlimited if empty")
+	flag.StringVar(&fleetDownloadRate, "fleet-download-rate", "", "download rate cap for all devices together, e.g. 100mbit (unlimited if empty)")
+	flag.DurationVar(&faultLatency, "fault-latency", 0, "latency injected into every request of the devices")
+	flag.DurationVar(&faultJitter, "fault-jitter", 0, "maximum random latency injected on top of -fault-latency")
+	flag.Float64Var(&faultResetRate, "fault-reset-rate", 0, "ratio of requests failed with a connection reset after being sent")
+	flag.Float64Var(&faultPartialUploadRate, "fault-partial-upload-rate", 0, "ratio of request bodies cut off half way through")
+	flag.Float64Var(&faultPartialBodyRate, "fault-partial-body-rate", 0, "ratio of response bodies cut off half way through")
+	flag.Float64Var(&faultDNSRate, "fault-dns-rate", 0, "ratio of requests failed with a name resolution error")
+	flag.Float64Var(&faultTimeoutRate, "fault-timeout-rate", 0, "ratio of requests hanging for -fault-timeout and then timing out")
+	flag.DurationVar(&faultTimeout, "fault-timeout", 30*time.Second, "how long requests hit by -fault-timeout-rate hang")
+	flag.StringVar(&retryProfile, "retry", retryReal, "how devices retry failed requests: real (exponential backoff like the real client) or aggressive (every second)")
+	flag.DurationVar(&retryMaxInterval, "retry-max-interval", 5*time.Minute, "cap on the interval between retries of the real retry profile")
+	flag.StringVar(&preauthManifest, "preauth-manifest", "", "write the identity data and public key of every device to this file, as CSV if it ends in .csv, JSON otherwise")
+	flag.BoolVar(&preauthPush, "preauth", false, "preauthorize all devices through the management API of the backend before starting them")
+	flag.StringVar(&managementToken, "management-token", "", "user JWT for the management API, needed by -preauth")
+	flag.StringVar(&identityTemplate, "identity", "mac={mac}", "identity attributes as name=template pairs distinguished with ','; templates may use {seq}, {seq:N}, {uuid}, {mac} and {hex:N}, e.g. serial=SN-{seq:6},mac={mac}")
+	flag.Int64Var(&identitySeed, "identity-seed", 0, "derive random identity values from this seed and the device index instead of at random (0 disables)")
+	flag.StringVar(&keyType, "key-type", keyRSA3072, "algorithm of generated device keys: rsa2048, rsa3072, rsa4096, ecdsa-p256, ecdsa-p384 or ed25519")
+	flag.StringVar(&deviceRanges, "devices", "", "run the devices with these indices, e.g. 0-999,2000-2099 (default: any)")
+	flag.StringVar(&deviceCohort, "device-cohort", "", "run the devices generated for this cohort")
+	flag.StringVar(&deviceTags, "device-tags", "", "run the devices carrying all of these tags, distinguished with ','")
+	flag.StringVar(&caCert, "ca-cert", "", "PEM bundle of CA certificates to verify the backend with, on top of the system ones")
+	flag.StringVar(&clientCert, "client-cert", "", "PEM client certificate presented to backends requiring mutual TLS")
+	flag.StringVar(&clientKey, "client-key", "", "PEM key of the -client-cert")
+	flag.BoolVar(&insecureTLS, "insecure", false, "skip verifying the certificate of the backend")
+	flag.StringVar(&keysDir, "keys-dir", "keys", "key directory to take the devices from, as prepared by keygen -dir")
+	flag.StringVar(&stateDir, "state", "", "directory to persist device state in, so a restarted run resumes every device (disabled if empty)")
 
 	mrand.Seed(time.Now().UnixNano())
-
-	updatesPerformed = 0
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "mock-server" {
+		runMockServer(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		runKeygen(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 
 	if len(os.Args) == 1 {
@@ -85,134 +176,337 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	updatesLeftToFail = updateFailCount
-
-	if _, err := os.Stat("keys/"); os.IsNotExist(err) {
-		os.Mkdir("keys", 0700)
+	if metricsAddr != "" {
+		startMetricsServer(metricsAddr)
 	}
 
-	files, _ := filepath.Glob("keys/**")
-	keysMissing := menderClientCount - len(files)
+	var err error
+	if defaultBandwidth, err = parseBandwidth(downloadRate); err != nil {
+		log.Fatal(err)
+	}
+	if defaultIdentity, err = parseIdentityTemplate(identityTemplate); err != nil {
+		log.Fatal(err)
+	}
+	if defaultInventory, err = loadInventoryModel(inventoryModel); err != nil {
+		log.Fatal(err)
+	}
+	defaultSelection = &DeviceSelection{
+		Devices: deviceRanges,
+		Cohort:  deviceCohort,
+		Tags:    splitList(deviceTags),
+	}
+	if err := defaultSelection.parse(); err != nil {
+		log.Fatal(err)
+	}
+	if defaultArrivalSteps, err = parseArrivalSteps(arrivalSteps); err != nil {
+		log.Fatal(err)
+	}
 
-	if keysMissing <= 0 {
-		for i := 0; i < menderClientCount; i++ {
-			go clientScheduler(files[i])
+	scenario := defaultScenario()
+	if scenarioFile != "" {
+		if scenario, err = loadScenario(scenarioFile); err != nil {
+			log.Fatal(err)
 		}
+		backendHost = scenario.Backend
+		tenantToken = scenario.Tenant
 	} else {
+		if err := scenario.Cohorts[0].Faults.validate(); err != nil {
+			log.Fatal(err)
+		}
+		if scenario.Cohorts[0].inventory, err = parseInventoryItems(inventoryItems); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-		for _, file := range files {
-			go clientScheduler(file)
+	if err := scenario.Arrival.validate(scenario.deviceCount()); err != nil {
+		log.Fatal(err)
+	}
+	if !validDownloadMode(downloadMode) {
+		log.Fatalf("unknown download mode %q", downloadMode)
+	}
+	if !validKeyType(keyType) {
+		log.Fatalf("unknown key type %q", keyType)
+	}
+	if !validRetryProfile(retryProfile) {
+		log.Fatalf("unknown retry profile %q", retryProfile)
+	}
+	if !validTimerMode(timerMode) {
+		log.Fatalf("unknown timer mode %q", timerMode)
+	}
+	if timerJitter < 0 || timerJitter > 100 {
+		log.Fatal("-timer-jitter must be between 0 and 100")
+	}
+	if pollFrequency <= 0 || inventoryUpdateFrequency <= 0 {
+		log.Fatal("-pollfreq and -invfreq must be positive")
+	}
+	if !validInventoryPolicy(inventoryPolicy) {
+		log.Fatalf("unknown inventory policy %q", inventoryPolicy)
+	}
+	if backendTLS, err = scenario.TLS.config(); err != nil {
+		log.Fatal(err)
+	}
+	if scenario.FleetDownloadRate != "" {
+		rate, err := parseBitrate(scenario.FleetDownloadRate)
+		if err != nil {
+			log.Fatal(err)
 		}
+		fleetLimiter = newRateLimiter(rate)
+	}
 
-		fmt.Printf("%d keys need to be generated..\n", keysMissing)
+	if stateDir != "" {
+		if err := openStateStore(stateDir); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-		for keysMissing > 0 {
-			filename, err := generateClientKeys()
+	fleet, err := openFleet(scenario.KeysDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the keys are checked once, before the first manifest is written
+	if fleet.unsaved {
+		fleet.check(runtime.NumCPU())
+	}
+	keys, err := fleet.assign(scenario.Cohorts, runtime.NumCPU())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-			if err != nil {
-				log.Fatal("failed to generate crypto keys!")
+	if preauthPush && managementToken == "" {
+		log.Fatal("-preauth needs a -management-token")
+	}
+	if preauthManifest != "" || preauthPush {
+		var files []string
+		for _, cohortKeys := range keys {
+			for _, k := range cohortKeys {
+				files = append(files, k.path)
+			}
+		}
+		entries, err := preauthEntries(files)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if preauthManifest != "" {
+			if err := writePreauthManifest(preauthManifest, entries); err != nil {
+				log.Fatal(err)
+			}
+			log.Infof("wrote preauth manifest of %d devices to %s", len(entries), preauthManifest)
+		}
+		if preauthPush {
+			if err := pushPreauth(backendHost, managementToken, entries); err != nil {
+				log.Fatal(err)
 			}
-
-			go clientScheduler("keys/" + filename)
-			keysMissing--
 		}
-
 	}
 
-	files, _ = filepath.Glob("keys/**")
+	arrivals = newArrivalGate(*scenario.Arrival, scenario.deviceCount())
+	go arrivals.run()
 
-	// block forever
-	select {}
-}
-
-func generateClientKeys() (string, error) {
-	buf := make([]byte, 6)
-	rand.Read(buf)
+	for i, cohort := range scenario.Cohorts {
+		log.Info("starting cohort ", cohort)
+		cohort.start(keys[i])
+	}
 
-	fakeMACaddress := fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", buf[0], buf[1], buf[2], buf[3], buf[4], buf[5])
-	log.Debug("created device with fake mac address: ", fakeMACaddress)
+	if controlAddr != "" {
+		startControlServer(controlAddr, scenario, fleet)
+	}
 
-	ms := store.NewDirStore("keys/")
-	kstore := store.NewKeystore(ms, fakeMACaddress)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-	if err := kstore.Generate(); err != nil {
-		return "", err
+	var timeout <-chan time.Time
+	if runDuration > 0 {
+		timeout = time.After(time.Duration(runDuration) * time.Second)
 	}
 
-	if err := kstore.Save(); err != nil {
-		return "", err
+	select {
+	case sig := <-signals:
+		log.Infof("received %v, stopping", sig)
+	case <-timeout:
+		log.Infof("run duration of %ds reached, stopping", runDuration)
 	}
 
-	return fakeMACaddress, nil
+	finishRun(scenario.deviceCount(), reportFile)
 }
 
-func clientScheduler(storeFile string) {
-	clientUpdateTicker := time.NewTicker(time.Second * time.Duration(pollFrequency))
-	clientInventoryTicker := time.NewTicker(time.Second * time.Duration(inventoryUpdateFrequency))
+// generateClientKeys creates a device key of the given type
+func generateClientKeys(path string, keyType string) error {
+	key, err := generateDeviceKey(keyType)
+	if err != nil {
+		return err
+	}
+	if err := key.save(path); err != nil {
+		return err
+	}
 
-	api, err := client.New(client.Config{
-		IsHttps:  true,
-		NoVerify: true,
-	})
+	log.Debugf("created %s device key %s", keyType, path)
+	return nil
+}
+
+func clientScheduler(dev *fakeDevice, stop <-chan struct{}) {
+	cohort := dev.cohort
 
+	api, err := client.New(client.Config{})
 	if err != nil {
 		log.Fatal(err)
 	}
+	configureTLS(api.Transport.(*http.Transport))
+	api.Transport = &instrumentedTransport{next: withFaults(api.Transport, cohort.Faults)}
+
+	if !arrivals.wait(stop) {
+		return
+	}
 
-	token := clientAuthenticate(api, storeFile)
+	if token := dev.authToken(); token != "" && tokenValid(api, token, dev) {
+		log.Debugf("device %s: reusing saved auth token of device ID %s", dev.name(), dev.tokenClaims().DeviceID)
+	} else if !clientAuthenticate(api, dev, stop) {
+		return
+	}
+	arrivals.deviceAuthenticated()
+
+	if dep := dev.pendingDeployment(); dep != nil {
+		log.Infof("device %s: resuming deployment %s at step %d of %d", dev.name(), dep.Update.ID, dep.Next+1, len(dep.Cycle))
+		resumeFakeUpdate(dep, api, dev, stop)
+	}
+
+	// the real client submits its inventory right after booting
+	if cohort.InventoryPolicy != invPolicyPeriodic {
+		submitInventory(api, dev, stop)
+	}
+
+	tokenRefreshTimer := time.NewTimer(dev.tokenRefreshDelay())
+	defer tokenRefreshTimer.Stop()
+
+	clientUpdateTimer := cohort.newTimer(cohort.pollInterval, cohort.TimerJitter/100)
+	clientInventoryTimer := cohort.newTimer(cohort.inventoryInterval, cohort.inventoryTimerJitter())
+	defer clientUpdateTimer.Stop()
+	defer clientInventoryTimer.Stop()
 
 	for {
 		select {
-		case <-clientInventoryTicker.C:
-			invItems := parseInventoryItems()
-			sendInventoryUpdate(api, token, &invItems)
+		case <-tokenRefreshTimer.C:
+			// the token may have been replaced since the timer was set
+			if dev.untilTokenRefresh() <= 0 {
+				log.Infof("device %s: refreshing auth token before it expires", dev.name())
+				if !clientAuthenticate(api, dev, stop) {
+					return
+				}
+			}
+			tokenRefreshTimer.Reset(dev.tokenRefreshDelay())
 
-		case <-clientUpdateTicker.C:
-			checkForNewUpdate(api, token)
+		case <-clientInventoryTimer.C:
+			if !cohort.isPaused() {
+				submitInventory(api, dev, stop)
+			}
+			clientInventoryTimer.rearm()
+
+		case <-clientUpdateTimer.C:
+			if !cohort.isPaused() {
+				pollForUpdate(api, dev, stop)
+			}
+			clientUpdateTimer.rearm()
+
+		case <-cohort.pollNow.wait():
+			if !cohort.isPaused() {
+				pollForUpdate(api, dev, stop)
+			}
+
+		case <-cohort.reconfigured.wait():
+			clientUpdateTimer.restart()
+			clientInventoryTimer.restart()
+
+		case <-stop:
+			log.Debug("stopping device ", dev.name())
+			return
 		}
 	}
 }
 
-func clientAuthenticate(c *client.ApiClient, storeFile string) client.AuthToken {
-	macAddress := filepath.Base(storeFile)
-	identityData := map[string]string{"mac": macAddress}
-	encdata, _ := json.Marshal(identityData)
+// clientAuthenticate authenticates the device until it is given a token,
+// which is stored on the device; false if stopped before that
+func clientAuthenticate(c *client.ApiClient, dev *fakeDevice, stop <-chan struct{}) bool {
+	cohort := dev.cohort
+	encdata, _ := json.Marshal(dev.identity)
 
-	ms := store.NewDirStore(filepath.Dir(storeFile))
-	kstore := store.NewKeystore(ms, macAddress)
-	kstore.Load()
+	key, err := loadDeviceKey(dev.storeFile)
+	if err != nil {
+		log.Errorf("device %s: %v", dev.name(), err)
+		return false
+	}
 
 	authReq := client.NewAuth()
 
 	mgr := &FakeMenderAuthManager{
-		store:       ms,
-		keyStore:    kstore,
+		keyStore:    key,
 		idSrc:       encdata,
 		tenantToken: tenantToken,
+		device:      dev,
 	}
 
-	kstore.Save()
-
-	for {
-		if authTokenResp, err := authReq.Request(c, backendHost, mgr); err == nil && len(authTokenResp) > 0 {
-			return client.AuthToken(authTokenResp)
-		} else if err != nil {
+	rejections := 0
+	for tried := 0; ; tried++ {
+		authAttempts.Inc()
+		authTokenResp, err := authReq.Request(c, backendHost, mgr)
+		if err == nil && len(authTokenResp) > 0 {
+			if err = mgr.RecvAuthResponse(authTokenResp); err == nil {
+				authSuccesses.Inc()
+				dev.setRejected(false)
+				return true
+			}
+		}
+		if err != nil {
 			log.Debug("not able to authorize client: ", err)
 		}
 
-		time.Sleep(time.Duration(pollFrequency) * time.Second)
+		if err == client.AuthErrorUnauthorized {
+			if rejections++; rejections == rejectedAfter {
+				dev.setRejected(true)
+			}
+		} else {
+			rejections = 0
+		}
+
+		wait, ok := cohort.backoff(tried)
+		if !ok {
+			// like the real client, start backing off all over again
+			tried = -1
+			wait, _ = cohort.backoff(0)
+		}
+		requestRetries.Inc(opAuthRequest)
+
+		if !sleep(wait, stop) {
+			return false
+		}
 	}
 }
 
-func checkForNewUpdate(c *client.ApiClient, token client.AuthToken) {
+// tokenValid checks whether a token saved by an earlier run is still accepted
+func tokenValid(c *client.ApiClient, token client.AuthToken, dev *fakeDevice) bool {
+	_, err := client.NewUpdate().GetScheduledUpdate(c.Request(token), backendHost, dev.current())
+	return err != client.ErrNotAuthorized
+}
 
-	// if we performed an update for all the devices, we should reset the number of failed updates to perform
-	if updatesPerformed > 0 && updatesPerformed%menderClientCount == 0 {
-		updatesLeftToFail = updateFailCount
+// pollForUpdate checks for an update and performs it; the real client
+// submits its inventory after an update changed what it is running
+func pollForUpdate(c *client.ApiClient, dev *fakeDevice, stop <-chan struct{}) {
+	running := dev.current()
+	checkForNewUpdate(c, dev, stop)
+	if dev.cohort.InventoryPolicy != invPolicyPeriodic && dev.current() != running {
+		submitInventory(c, dev, stop)
 	}
+}
 
+func checkForNewUpdate(c *client.ApiClient, dev *fakeDevice, stop <-chan struct{}) {
 	updater := client.NewUpdate()
-	haveUpdate, err := updater.GetScheduledUpdate(c.Request(client.AuthToken(token)), backendHost, client.CurrentUpdate{DeviceType: currentDeviceType, Artifact: currentArtifact})
+	var haveUpdate interface{}
+	err := withReauth(c, dev, stop, func() error {
+		return dev.cohort.retryPeriodic(opUpdateCheck, stop, func() (err error) {
+			start := time.Now()
+			haveUpdate, err = updater.GetScheduledUpdate(c.Request(dev.authToken()), backendHost, dev.current())
+			updatePollDuration.ObserveDuration(start, resultLabel(err))
+			return err
+		})
+	})
 
 	if err != nil {
 		log.Info("failed when checking for new updates with: ", err.Error())
@@ -220,43 +514,72 @@ func checkForNewUpdate(c *client.ApiClient, token client.AuthToken) {
 
 	if haveUpdate != nil {
 		u := haveUpdate.(client.UpdateResponse)
-		performFakeUpdate(u.Artifact.Source.URI, u.ID, c.Request(client.AuthToken(token)))
+		performFakeUpdate(u, c, dev, stop)
 	}
 }
 
-func performFakeUpdate(url string, did string, token client.ApiRequester) {
-	s := client.NewStatus()
-	substate := ""
+func performFakeUpdate(update client.UpdateResponse, api *client.ApiClient, dev *fakeDevice, stop <-chan struct{}) {
 	reportingCycle := []string{"downloading", "installing", "rebooting"}
 
-	lock.Lock()
-	if len(updateFailMsg) > 0 && updatesLeftToFail > 0 {
+	if dev.cohort.nextUpdateFails() {
 		reportingCycle = append(reportingCycle, "failure")
-		updatesLeftToFail -= 1
 	} else {
 		reportingCycle = append(reportingCycle, "success")
 	}
-	updatesPerformed += 1
-	lock.Unlock()
 
-	for _, event := range reportingCycle {
-		time.Sleep(15 + time.Duration(mrand.Intn(maxWaitSteps))*time.Second)
+	resumeFakeUpdate(dev.startUpdate(update, reportingCycle), api, dev, stop)
+}
+
+// resumeFakeUpdate walks through the reporting cycle of a deployment,
+// starting at the first status not reported yet
+func resumeFakeUpdate(dep *deploymentState, api *client.ApiClient, dev *fakeDevice, stop <-chan struct{}) {
+	cohort := dev.cohort
+	update := dep.Update
+	did := update.ID
+	s := client.NewStatus()
+	substate := ""
+
+	for step := dep.Next; step < len(dep.Cycle); step++ {
+		event := dep.Cycle[step]
+		// a stopped device leaves the deployment to be resumed when it is
+		// started again
+		if !sleep(randomWait(cohort.maxWait()), stop) {
+			return
+		}
 		if event == "downloading" {
-			if err := downloadToDevNull(url); err != nil {
+			if err := downloadUpdate(api, update, dev); err != nil {
 				log.Warn("failed to download update: ", err)
+				// a broken artifact fails the update, unless it is
+				// downloaded without looking at it
+				if cohort.Download != downloadPlain {
+					dev.failUpdate(step, err.Error())
+				}
 			}
 		}
 
 		if event == "failure" {
 			logUploader := client.NewLog()
 
+			msg := cohort.FailMessage
+			if dep.FailMessage != "" {
+				msg = dep.FailMessage
+			}
 			ld := client.LogData{
 				DeploymentID: did,
-				Messages:     []byte(fmt.Sprintf("{\"messages\": [{\"level\": \"debug\", \"message\": \"%s\", \"timestamp\": \"2012-11-01T22:08:41+00:00\"}]}", updateFailMsg)),
+				Messages:     failureLogs(msg),
 			}
 
-			if err := logUploader.Upload(token, backendHost, ld); err != nil {
+			err := withReauth(api, dev, stop, func() error {
+				return cohort.retry(opLogUpload, stop, func() error {
+					return logUploader.Upload(api.Request(dev.authToken()), backendHost, ld)
+				})
+			})
+			if stopped(stop) {
+				return
+			}
+			if err != nil {
 				log.Warn("failed to deliver fail logs to backend: " + err.Error())
+				dev.finishUpdate(update, outcomeFailure)
 				return
 			}
 		}
@@ -273,36 +596,84 @@ func performFakeUpdate(url string, did string, token client.ApiRequester) {
 		}
 
 		report := client.StatusReport{DeploymentID: did, Status: event, SubState: substate}
-		err := s.Report(token, backendHost, report)
-
-		if err != nil {
+		err := withReauth(api, dev, stop, func() error {
+			return cohort.retry(opStatusReport, stop, func() error {
+				err := s.Report(api.Request(dev.authToken()), backendHost, report)
+				statusReports.Inc(event, resultLabel(err))
+				return err
+			})
+		})
+
+		if stopped(stop) {
+			return
+		}
+		if err == client.ErrDeploymentAborted {
+			log.Infof("deployment %s aborted by the backend while %s, stopping update", did, event)
+			stats.recordOutcome(outcomeAborted)
+			dev.finishUpdate(update, outcomeAborted)
+			return
+		} else if err != nil {
 			log.Warn("error reporting update status: ", err.Error())
 		}
+		dev.advanceUpdate(step)
+	}
+
+	outcome := dep.Cycle[len(dep.Cycle)-1]
+	stats.recordOutcome(outcome)
+	dev.finishUpdate(update, outcome)
+}
+
+// submitInventory submits the inventory of the device; with the diff policy
+// only if it changed since the last submit
+func submitInventory(c *client.ApiClient, dev *fakeDevice, stop <-chan struct{}) {
+	invItems := dev.inventory()
+	if dev.cohort.InventoryPolicy == invPolicyDiff && !dev.inventoryChanged(invItems) {
+		log.Debugf("device %s: inventory unchanged, not submitting it", dev.name())
+		inventorySubmitsSkipped.Inc()
+		return
+	}
+	if sendInventoryUpdate(c, dev, &invItems, stop) == nil {
+		dev.inventorySubmitted(invItems)
 	}
 }
 
-func sendInventoryUpdate(c *client.ApiClient, token client.AuthToken, invAttrs *[]client.InventoryAttribute) {
+func sendInventoryUpdate(c *client.ApiClient, dev *fakeDevice, invAttrs *[]client.InventoryAttribute, stop <-chan struct{}) error {
 	log.Debug("submitting inventory update with: ", invAttrs)
-	if err := client.NewInventory().Submit(c.Request(client.AuthToken(token)), backendHost, invAttrs); err != nil {
+	err := withReauth(c, dev, stop, func() error {
+		return dev.cohort.retryPeriodic(opInventorySubmit, stop, func() error {
+			start := time.Now()
+			err := client.NewInventory().Submit(c.Request(dev.authToken()), backendHost, invAttrs)
+			inventorySubmitDuration.ObserveDuration(start)
+			if err != nil {
+				inventorySubmitErrors.Inc()
+			}
+			return err
+		})
+	})
+	if err != nil {
 		log.Warn("failed sending inventory with: ", err.Error())
 	}
+	return err
 }
 
-func downloadToDevNull(url string) error {
+func downloadToDevNull(url string, faults *Faults, limiters ...*rateLimiter) error {
 	log.Info("downloading url")
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
+	tr := &http.Transport{}
+	configureTLS(tr)
+	client := &http.Client{Transport: &instrumentedTransport{next: withFaults(tr, faults)}}
 
+	start := time.Now()
 	resp, err := client.Get(url)
 	if err != nil {
+		downloadDuration.ObserveDuration(start, resultLabel(err))
 		log.Error("failed grabbing update: ", url)
 		return err
 	}
 	defer resp.Body.Close()
 
-	_, err = io.Copy(ioutil.Discard, resp.Body)
+	n, err := io.Copy(ioutil.Discard, shapeReader(resp.Body, limiters...))
+	downloadBytes.Add(float64(n))
+	downloadDuration.ObserveDuration(start, resultLabel(err))
 
 	if err != nil {
 		return err
@@ -311,19 +682,46 @@ func downloadToDevNull(url string) error {
 	return nil
 }
 
-func parseInventoryItems() []client.InventoryAttribute {
-	var invAttrs []client.InventoryAttribute
-	for _, e := range strings.Split(inventoryItems, ",") {
-		pair := strings.Split(e, ":")
-		if pair != nil {
-			key := pair[0]
-			value := pair[1]
-			i := client.InventoryAttribute{Name: key, Value: value}
-			invAttrs = append(invAttrs, i)
-		}
+// failureLogs formats the deployment logs uploaded for a failed update
+func failureLogs(msg string) []byte {
+	logs := map[string]interface{}{
+		"messages": []map[string]string{{
+			"level":     "debug",
+			"message":   msg,
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+		}},
+	}
+	data, _ := json.Marshal(logs)
+	return data
+}
+
+// sleep waits for d, false if the device is stopped before that
+func sleep(d time.Duration, stop <-chan struct{}) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// stopped tells whether the device has been stopped
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// randomWait picks a random whole number of seconds up to max
+func randomWait(max time.Duration) time.Duration {
+	seconds := int(max / time.Second)
+	if seconds <= 0 {
+		return 0
 	}
-	// add a dynamic inventory inventoryItems
-	i := client.InventoryAttribute{Name: "time", Value: time.Now().Unix()}
-	invAttrs = append(invAttrs, i)
-	return invAttrs
+	return time.Duration(mrand.Intn(seconds)) * time.Second
 }
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+)
+
+// default histogram buckets in seconds, roughly matching the ones used by
+// the prometheus client library
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// metric is anything that can write itself in the prometheus text format
+type metric interface {
+	write(w io.Writer)
+}
+
+type metricsRegistry struct {
+	sync.Mutex
+	metrics []metric
+}
+
+var registry = &metricsRegistry{}
+
+func (r *metricsRegistry) register(m metric) {
+	r.Lock()
+	defer r.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	r.Lock()
+	defer r.Unlock()
+	for _, m := range r.metrics {
+		m.write(w)
+	}
+}
+
+// labelKey joins label values so they can be used as a map key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func formatLabels(names []string, key string, extra ...string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", names[i], v))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type counterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+	registry.register(c)
+	return c
+}
+
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	c.Lock()
+	c.values[labelKey(labelValues)] += v
+	c.Unlock()
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.writeAs(w, "counter")
+}
+
+func (c *counterVec) writeAs(w io.Writer, kind string) {
+	c.Lock()
+	defer c.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", c.name, c.help, c.name, kind)
+	keys := make(map[string]bool)
+	for k := range c.values {
+		keys[k] = true
+	}
+	for _, k := range sortedKeys(keys) {
+		fmt.Fprintf(w, "%s%s %v\n", c.name, formatLabels(c.labels, k), c.values[k])
+	}
+}
+
+// gaugeVec is a counterVec whose values may also go down
+type gaugeVec struct {
+	counterVec
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}}
+	registry.register(g)
+	return g
+}
+
+func (g *gaugeVec) Set(v float64, labelValues ...string) {
+	g.Lock()
+	g.values[labelKey(labelValues)] = v
+	g.Unlock()
+}
+
+func (g *gaugeVec) write(w io.Writer) {
+	g.writeAs(w, "gauge")
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	h := &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: defaultBuckets,
+		values:  make(map[string]*histogram),
+	}
+	registry.register(h)
+	return h
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+
+	key := labelKey(labelValues)
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *histogramVec) ObserveDuration(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make(map[string]bool)
+	for k := range h.values {
+		keys[k] = true
+	}
+	for _, k := range sortedKeys(keys) {
+		hist := h.values[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", fmt.Sprint(b)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, formatLabels(h.labels, k), hist.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, k), hist.count)
+	}
+}
+
+var (
+	authAttempts = newCounterVec("mender_stress_auth_attempts_total",
+		"Number of authorization requests sent by simulated devices.")
+	deviceArrivals = newCounterVec("mender_stress_device_arrivals_total",
+		"Number of devices let online by the arrival model.")
+	authSuccesses = newCounterVec("mender_stress_auth_success_total",
+		"Number of authorization requests that returned a token.")
+	updatePollDuration = newHistogramVec("mender_stress_update_poll_duration_seconds",
+		"Latency of deployments/next update checks.", "result")
+	inventorySubmitDuration = newHistogramVec("mender_stress_inventory_submit_duration_seconds",
+		"Latency of inventory attribute submits.")
+	inventorySubmitErrors = newCounterVec("mender_stress_inventory_submit_errors_total",
+		"Number of failed inventory attribute submits.")
+	inventorySubmitsSkipped = newCounterVec("mender_stress_inventory_submits_skipped_total",
+		"Number of inventory submits skipped as the inventory did not change.")
+	downloadBytes = newCounterVec("mender_stress_download_bytes_total",
+		"Number of artifact bytes downloaded by simulated devices.")
+	downloadDuration = newHistogramVec("mender_stress_download_duration_seconds",
+		"Time taken to download an artifact.", "result")
+	deploymentOutcomes = newCounterVec("mender_stress_deployments_total",
+		"Number of deployments handled by simulated devices, by outcome.", "outcome")
+	statusReports = newCounterVec("mender_stress_status_reports_total",
+		"Number of deployment status reports sent, by status value.", "status", "result")
+	requestRetries = newCounterVec("mender_stress_request_retries_total",
+		"Number of failed requests retried after backing off, by operation.", "operation")
+	tokenRefreshes = newCounterVec("mender_stress_token_refreshes_total",
+		"Number of times a device authenticated again after its token was refused.")
+	tlsHandshakeFailures = newCounterVec("mender_stress_tls_handshake_failures_total",
+		"Number of requests failed in the TLS handshake, by operation.", "operation")
+	rejectedDevices = newGaugeVec("mender_stress_rejected_devices",
+		"Number of devices whose authorization requests keep being rejected.")
+)
+
+// resultLabel maps an error to the value of the "result" label
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+
+	log.Infof("serving metrics on http://%s/metrics", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatal("metrics listener failed: ", err)
+		}
+	}()
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math/big"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender-artifact/awriter"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/pkg/errors"
+)
+
+const (
+	mockAPIPrefix      = "/api/devices/v1"
+	mockArtifactPrefix = "/artifacts/"
+	mockDeploymentID   = "00000000-0000-0000-0000-000000000001"
+)
+
+// mockConfig holds the knobs of the mock backend
+type mockConfig struct {
+	addr             string
+	acceptRatio      float64
+	latency          time.Duration
+	jitter           time.Duration
+	errorRate        float64
+	abortRate        float64
+	artifactName     string
+	artifactSize     int64
+	deviceTypes      string
+	corruptRate      float64
+	truncateRate     float64
+	verifySignatures bool
+	tokenLifetime    time.Duration
+	recordFile       string
+	keep             int
+	tlsCert          string
+	tlsKey           string
+	clientCA         string
+}
+
+// mockRequest is what the mock backend records about every request it serves
+type mockRequest struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Query    string    `json:"query,omitempty"`
+	DeviceID string    `json:"device_id,omitempty"`
+	Status   int       `json:"status"`
+	Body     string    `json:"body,omitempty"`
+}
+
+type mockServer struct {
+	conf mockConfig
+	// artifact is the served mender artifact
+	artifact []byte
+
+	lock sync.Mutex
+	// requests is a ring of the last conf.keep requests, the oldest at next
+	requests []mockRequest
+	next     int
+	record   io.Writer
+	// tokens maps issued tokens to the devices they were issued to
+	tokens map[string]mockToken
+	// preauthorized maps preauthorized device IDs to their public keys
+	preauthorized map[string]string
+}
+
+type mockToken struct {
+	deviceID string
+	expires  time.Time
+}
+
+func newMockServer(conf mockConfig) *mockServer {
+	return &mockServer{
+		conf:          conf,
+		tokens:        make(map[string]mockToken),
+		preauthorized: make(map[string]string),
+	}
+}
+
+func runMockServer(args []string) {
+	var conf mockConfig
+
+	fs := flag.NewFlagSet("mock-server", flag.ExitOnError)
+	fs.StringVar(&conf.addr, "listen", ":8080", "address to listen on")
+	fs.Float64Var(&conf.acceptRatio, "accept", 1, "ratio of devices whose authorization requests are accepted")
+	fs.DurationVar(&conf.latency, "latency", 0, "latency added to every response")
+	fs.DurationVar(&conf.jitter, "jitter", 0, "maximum random latency added on top of -latency")
+	fs.Float64Var(&conf.errorRate, "error-rate", 0, "ratio of device API requests answered with 500 Internal Server Error")
+	fs.Float64Var(&conf.abortRate, "abort-rate", 0, "ratio of status reports answered with 409, aborting the deployment")
+	fs.StringVar(&conf.artifactName, "artifact", "", "artifact to deploy to every device not running it yet (no deployments if empty)")
+	fs.Int64Var(&conf.artifactSize, "artifact-size", 1024*1024, "size in bytes of the served artifact payload")
+	fs.StringVar(&conf.deviceTypes, "device-types", "test", "device types the served artifact is compatible with, distinguished with ','")
+	fs.Float64Var(&conf.corruptRate, "corrupt-rate", 0, "ratio of artifact downloads served with a corrupted payload")
+	fs.Float64Var(&conf.truncateRate, "truncate-rate", 0, "ratio of artifact downloads cut off half way through")
+	fs.BoolVar(&conf.verifySignatures, "verify", true, "verify the signature of authorization requests")
+	fs.DurationVar(&conf.tokenLifetime, "token-lifetime", 24*time.Hour, "lifetime of the issued device tokens")
+	fs.StringVar(&conf.recordFile, "record", "", "append every received request as a JSON line to this file")
+	fs.IntVar(&conf.keep, "keep", 1000, "number of the last received requests returned by /mock/requests")
+	fs.StringVar(&conf.tlsCert, "tls-cert", "", "PEM server certificate to serve HTTPS with (plain HTTP if empty)")
+	fs.StringVar(&conf.tlsKey, "tls-key", "", "PEM key of the -tls-cert")
+	fs.StringVar(&conf.clientCA, "client-ca", "", "PEM bundle of CA certificates; require clients to present a certificate signed by one of them")
+	fs.Parse(args)
+
+	m := newMockServer(conf)
+	if conf.artifactName != "" {
+		artifact, err := buildMockArtifact(conf.artifactName, strings.Split(conf.deviceTypes, ","), conf.artifactSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		m.artifact = artifact
+		log.Infof("serving artifact %s of %d bytes", conf.artifactName, len(artifact))
+	}
+
+	if conf.recordFile != "" {
+		f, err := os.OpenFile(conf.recordFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		m.record = f
+	}
+
+	if conf.tlsCert == "" {
+		if conf.clientCA != "" {
+			log.Fatal("-client-ca needs -tls-cert and -tls-key")
+		}
+		log.Infof("mock backend listening on %s", conf.addr)
+		log.Fatal(http.ListenAndServe(conf.addr, m.handler()))
+	}
+
+	srv := &http.Server{Addr: conf.addr, Handler: m.handler(), TLSConfig: &tls.Config{}}
+	if conf.clientCA != "" {
+		data, err := ioutil.ReadFile(conf.clientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			log.Fatalf("no certificates found in %s", conf.clientCA)
+		}
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	log.Infof("mock backend listening on %s (HTTPS)", conf.addr)
+	log.Fatal(srv.ListenAndServeTLS(conf.tlsCert, conf.tlsKey))
+}
+
+func (m *mockServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(mockAPIPrefix+"/authentication/auth_requests", m.handleAuth)
+	mux.HandleFunc(mockAPIPrefix+"/deployments/device/deployments/", m.handleDeployments)
+	mux.HandleFunc(mockAPIPrefix+"/inventory/device/attributes", m.handleInventory)
+	mux.HandleFunc(preauthPath, m.handlePreauth)
+	mux.HandleFunc(mockArtifactPrefix, m.handleArtifact)
+	mux.HandleFunc("/mock/requests", m.handleRecorded)
+	return mux
+}
+
+func (m *mockServer) logRequest(r *http.Request, deviceID string, status int, body []byte) {
+	req := mockRequest{
+		Time:     time.Now(),
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Query:    r.URL.RawQuery,
+		DeviceID: deviceID,
+		Status:   status,
+		Body:     string(body),
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.requests) < m.conf.keep {
+		m.requests = append(m.requests, req)
+	} else if m.conf.keep > 0 {
+		m.requests[m.next] = req
+		m.next = (m.next + 1) % m.conf.keep
+	}
+	if m.record != nil {
+		data, _ := json.Marshal(req)
+		m.record.Write(append(data, '\n'))
+	}
+}
+
+// respond applies the configured latency and error injection; it returns
+// false if an error was injected and the request must not be handled
+func (m *mockServer) respond(w http.ResponseWriter, r *http.Request, deviceID string, body []byte) bool {
+	delay := m.conf.latency
+	if m.conf.jitter > 0 {
+		delay += time.Duration(mrand.Int63n(int64(m.conf.jitter)))
+	}
+	time.Sleep(delay)
+
+	if m.conf.errorRate > 0 && mrand.Float64() < m.conf.errorRate {
+		m.logRequest(r, deviceID, http.StatusInternalServerError, body)
+		http.Error(w, "injected error", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func (m *mockServer) reply(w http.ResponseWriter, r *http.Request, deviceID string, body []byte, status int) {
+	m.logRequest(r, deviceID, status, body)
+	w.WriteHeader(status)
+}
+
+// authorize maps the bearer token of the request to a device ID; expired
+// tokens are rejected
+func (m *mockServer) authorize(r *http.Request) (string, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	t, ok := m.tokens[token]
+	if ok && time.Now().After(t.expires) {
+		delete(m.tokens, token)
+		return t.deviceID, false
+	}
+	return t.deviceID, ok
+}
+
+type mockAuthRequest struct {
+	IdData      string `json:"id_data"`
+	TenantToken string `json:"tenant_token"`
+	Pubkey      string `json:"pubkey"`
+}
+
+func verifyAuthSignature(body []byte, pubkeyPEM string, signature string) error {
+	block, _ := pem.Decode([]byte(pubkeyPEM))
+	if block == nil {
+		return errors.New("failed to decode public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.Wrapf(err, "failed to decode signature")
+	}
+	sum := sha256.Sum256(body)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig)
+	case *ecdsa.PublicKey:
+		var rs struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig, &rs); err != nil {
+			return errors.Wrapf(err, "failed to parse ECDSA signature")
+		}
+		if !ecdsa.Verify(pub, sum[:], rs.R, rs.S) {
+			return errors.New("ECDSA verification failed")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, body, sig) {
+			return errors.New("Ed25519 verification failed")
+		}
+		return nil
+	default:
+		return errors.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// mockDeviceID derives a stable device ID from the identity data
+func mockDeviceID(idData string) string {
+	sum := sha256.Sum256([]byte(idData))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// accepted decides whether a device is accepted; the decision is sticky for
+// a given device
+func (m *mockServer) accepted(deviceID string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(deviceID))
+	return float64(h.Sum32()%10000)/10000 < m.conf.acceptRatio
+}
+
+// isPreauthorized tells whether the device was preauthorized with this key
+func (m *mockServer) isPreauthorized(deviceID, pubkey string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key, ok := m.preauthorized[deviceID]
+	return ok && strings.TrimSpace(key) == strings.TrimSpace(pubkey)
+}
+
+// handlePreauth preauthorizes a device; the management token is not checked
+func (m *mockServer) handlePreauth(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Method != http.MethodPost {
+		m.reply(w, r, "", body, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req preauthEntry
+	if err := json.Unmarshal(body, &req); err != nil || len(req.IdentityData) == 0 || req.Pubkey == "" {
+		m.reply(w, r, "", body, http.StatusBadRequest)
+		return
+	}
+	identity, _ := json.Marshal(req.IdentityData)
+	deviceID := mockDeviceID(string(identity))
+
+	if !m.respond(w, r, deviceID, body) {
+		return
+	}
+
+	m.lock.Lock()
+	_, exists := m.preauthorized[deviceID]
+	if !exists {
+		m.preauthorized[deviceID] = req.Pubkey
+	}
+	m.lock.Unlock()
+
+	if exists {
+		m.reply(w, r, deviceID, body, http.StatusConflict)
+		return
+	}
+	m.reply(w, r, deviceID, body, http.StatusCreated)
+}
+
+func (m *mockServer) issueToken(deviceID, tenant string) string {
+	enc := base64.RawURLEncoding
+	expires := time.Now().Add(m.conf.tokenLifetime)
+	header, _ := json.Marshal(map[string]string{"alg": "none", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"sub":           deviceID,
+		"iss":           "mender-stress-test-client mock-server",
+		"exp":           expires.Unix(),
+		"jti":           fmt.Sprintf("%x", mrand.Int63()),
+		"mender.device": true,
+		"mender.tenant": tenant,
+	})
+	token := enc.EncodeToString(header) + "." + enc.EncodeToString(claims) + "."
+
+	m.lock.Lock()
+	m.tokens[token] = mockToken{deviceID: deviceID, expires: expires}
+	m.lock.Unlock()
+	return token
+}
+
+func (m *mockServer) handleAuth(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Method != http.MethodPost {
+		m.reply(w, r, "", body, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req mockAuthRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		m.reply(w, r, "", body, http.StatusBadRequest)
+		return
+	}
+	deviceID := mockDeviceID(req.IdData)
+
+	if !m.respond(w, r, deviceID, body) {
+		return
+	}
+
+	if m.conf.verifySignatures {
+		if err := verifyAuthSignature(body, req.Pubkey, r.Header.Get("X-MEN-Signature")); err != nil {
+			log.Warnf("device %s: bad signature: %v", deviceID, err)
+			m.reply(w, r, deviceID, body, http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if !m.isPreauthorized(deviceID, req.Pubkey) && !m.accepted(deviceID) {
+		m.reply(w, r, deviceID, body, http.StatusUnauthorized)
+		return
+	}
+
+	tenant := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer"))
+	token := m.issueToken(deviceID, tenant)
+	m.logRequest(r, deviceID, http.StatusOK, body)
+	w.Header().Set("Content-Type", "application/jwt")
+	w.Write([]byte(token))
+}
+
+func (m *mockServer) handleDeployments(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	deviceID, ok := m.authorize(r)
+	if !ok {
+		m.reply(w, r, deviceID, body, http.StatusUnauthorized)
+		return
+	}
+	if !m.respond(w, r, deviceID, body) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, mockAPIPrefix+"/deployments/device/deployments/")
+	switch {
+	case path == "next" && r.Method == http.MethodGet:
+		m.handleNextDeployment(w, r, deviceID)
+
+	case strings.HasSuffix(path, "/status") && r.Method == http.MethodPut:
+		if m.conf.abortRate > 0 && mrand.Float64() < m.conf.abortRate {
+			m.reply(w, r, deviceID, body, http.StatusConflict)
+			return
+		}
+		m.reply(w, r, deviceID, body, http.StatusNoContent)
+
+	case strings.HasSuffix(path, "/log") && r.Method == http.MethodPut:
+		m.reply(w, r, deviceID, body, http.StatusNoContent)
+
+	default:
+		m.reply(w, r, deviceID, body, http.StatusNotFound)
+	}
+}
+
+func (m *mockServer) handleNextDeployment(w http.ResponseWriter, r *http.Request, deviceID string) {
+	current := r.URL.Query().Get("artifact_name")
+	if m.conf.artifactName == "" || current == m.conf.artifactName {
+		m.reply(w, r, deviceID, nil, http.StatusNoContent)
+		return
+	}
+
+	deviceType := r.URL.Query().Get("device_type")
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	deployment := map[string]interface{}{
+		"id": mockDeploymentID,
+		"artifact": map[string]interface{}{
+			"artifact_name":           m.conf.artifactName,
+			"device_types_compatible": []string{deviceType},
+			"source": map[string]string{
+				"uri":    fmt.Sprintf("%s://%s%s%s", scheme, r.Host, mockArtifactPrefix, m.conf.artifactName),
+				"expire": time.Now().Add(24 * time.Hour).Format(time.RFC3339),
+			},
+		},
+	}
+	data, _ := json.Marshal(deployment)
+
+	m.logRequest(r, deviceID, http.StatusOK, nil)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (m *mockServer) handleInventory(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	deviceID, ok := m.authorize(r)
+	if !ok {
+		m.reply(w, r, deviceID, body, http.StatusUnauthorized)
+		return
+	}
+	if !m.respond(w, r, deviceID, body) {
+		return
+	}
+	if r.Method != http.MethodPatch {
+		m.reply(w, r, deviceID, body, http.StatusMethodNotAllowed)
+		return
+	}
+	m.reply(w, r, deviceID, body, http.StatusOK)
+}
+
+// buildMockArtifact writes a rootfs-image artifact with a random payload
+func buildMockArtifact(name string, deviceTypes []string, size int64) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "mock-artifact")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	payload := filepath.Join(dir, "rootfs.ext4")
+	f, err := os.Create(payload)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.CopyN(f, rand.Reader, size)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	upd := &awriter.Updates{U: []handlers.Composer{handlers.NewRootfsV2(payload)}}
+	if err := awriter.NewWriter(buf).WriteArtifact("mender", 2, deviceTypes, name, upd, nil); err != nil {
+		return nil, errors.Wrapf(err, "failed to write mock artifact")
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *mockServer) handleArtifact(w http.ResponseWriter, r *http.Request) {
+	if !m.respond(w, r, "", nil) {
+		return
+	}
+	if strings.TrimPrefix(r.URL.Path, mockArtifactPrefix) != m.conf.artifactName || m.artifact == nil {
+		m.reply(w, r, "", nil, http.StatusNotFound)
+		return
+	}
+	m.logRequest(r, "", http.StatusOK, nil)
+
+	artifact := m.artifact
+	if m.conf.corruptRate > 0 && mrand.Float64() < m.conf.corruptRate {
+		// flip a byte near the end, where the payload is
+		artifact = append([]byte(nil), artifact...)
+		artifact[len(artifact)*3/4] ^= 0xff
+	}
+
+	if m.conf.truncateRate > 0 && mrand.Float64() < m.conf.truncateRate {
+		// announce the whole artifact but hang up half way through
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", fmt.Sprint(len(artifact)))
+		w.Write(artifact[:len(artifact)/2])
+		return
+	}
+
+	// ServeContent takes care of the range requests used to resume downloads
+	http.ServeContent(w, r, m.conf.artifactName+".mender", time.Time{}, bytes.NewReader(artifact))
+}
+
+// recorded returns the last requests received, oldest first
+func (m *mockServer) recorded() []mockRequest {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append(append([]mockRequest{}, m.requests[m.next:]...), m.requests[:m.next]...)
+}
+
+// handleRecorded returns the last requests received, oldest first
+func (m *mockServer) handleRecorded(w http.ResponseWriter, r *http.Request) {
+	data, _ := json.Marshal(m.recorded())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDeviceLifecycle takes a device through authorization, an update and
+// its inventory submits against the mock backend
+func TestDeviceLifecycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stress-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newMockServer(mockConfig{
+		acceptRatio:      1,
+		artifactName:     "release-2",
+		verifySignatures: true,
+		tokenLifetime:    time.Hour,
+		keep:             1000,
+	})
+	if m.artifact, err = buildMockArtifact("release-2", []string{"test"}, 1024); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(m.handler())
+	defer srv.Close()
+
+	backendHost = srv.URL
+	arrivals = newArrivalGate(Arrival{}, 1)
+	arrivals.run()
+
+	keyFile := filepath.Join(dir, "02:00:00:00:00:01")
+	key, err := generateDeviceKey(keyEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.save(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	identity, err := loadIdentity(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inventory, err := parseInventoryItems("device_type=test,image_id=test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cohort := &Cohort{
+		Name:              "test",
+		Count:             1,
+		DeviceType:        "test",
+		Artifact:          "release-1",
+		PollInterval:      duration(50 * time.Millisecond),
+		InventoryInterval: duration(time.Hour),
+		InventoryPolicy:   invPolicyRealistic,
+		Download:          downloadValidate,
+		Timers:            timersDesync,
+		Retry:             retryAggressive,
+		Faults:            &Faults{},
+		inventory:         inventory,
+	}
+	dev := newFakeDevice(keyFile, 0, identity, cohort)
+
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		clientScheduler(dev, stop)
+	}()
+
+	// the device submits its inventory once more after the update changed
+	// what it is running
+	deadline := time.Now().Add(10 * time.Second)
+	for dev.current().Artifact != "release-2" || submittedArtifact(m.recorded()) != "release-2" {
+		if time.Now().After(deadline) {
+			close(stop)
+			t.Fatalf("device running %s did not finish the update, received %d requests", dev.current().Artifact, len(m.recorded()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-exited
+
+	var got []string
+	for _, r := range m.recorded() {
+		switch {
+		case strings.HasSuffix(r.Path, "/auth_requests"):
+			got = append(got, "auth")
+		case strings.HasSuffix(r.Path, "/next") && r.Status == http.StatusOK:
+			got = append(got, "deployment")
+		case strings.HasSuffix(r.Path, "/status"):
+			var report struct{ Status string }
+			json.Unmarshal([]byte(r.Body), &report)
+			got = append(got, report.Status)
+		case strings.HasPrefix(r.Path, mockArtifactPrefix):
+			got = append(got, "artifact")
+		case strings.HasSuffix(r.Path, "/attributes"):
+			got = append(got, "inventory")
+		}
+		if r.Status >= 400 {
+			t.Errorf("%s %s answered with %d", r.Method, r.Path, r.Status)
+		}
+	}
+	want := []string{"auth", "inventory", "deployment", "artifact", "downloading", "installing", "rebooting", "success", "inventory"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("requests were\n%v\nwant\n%v", got, want)
+	}
+}
+
+// submittedArtifact returns the artifact_name of the last inventory submit
+func submittedArtifact(requests []mockRequest) string {
+	name := ""
+	for _, r := range requests {
+		if !strings.HasSuffix(r.Path, "/attributes") {
+			continue
+		}
+		var attrs []struct {
+			Name  string
+			Value interface{}
+		}
+		json.Unmarshal([]byte(r.Body), &attrs)
+		for _, a := range attrs {
+			if a.Name == "artifact_name" {
+				name, _ = a.Value.(string)
+			}
+		}
+	}
+	return name
+}
+
+// TestRecordedOrder checks that the kept requests come back oldest first
+// once the ring has wrapped around
+func TestRecordedOrder(t *testing.T) {
+	m := newMockServer(mockConfig{keep: 3})
+	for _, path := range []string{"/a", "/b", "/c", "/d", "/e"} {
+		m.logRequest(httptest.NewRequest(http.MethodGet, path, nil), "", http.StatusOK, nil)
+	}
+
+	var paths []string
+	for _, req := range m.recorded() {
+		paths = append(paths, req.Path)
+	}
+	if got := strings.Join(paths, ","); got != "/c,/d,/e" {
+		t.Errorf("recorded %s, want /c,/d,/e", got)
+	}
+}
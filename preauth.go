@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// management API endpoint devices are preauthorized through
+const preauthPath = "/api/management/v2/devauth/devices"
+
+// number of devices preauthorized concurrently
+const preauthWorkers = 16
+
+// preauthEntry is a device as the deviceauth preauthorize API expects it
+type preauthEntry struct {
+	IdentityData map[string]string `json:"identity_data"`
+	Pubkey       string            `json:"pubkey"`
+}
+
+// preauthEntries loads the public key of every device key file
+func preauthEntries(keys []string) ([]preauthEntry, error) {
+	entries := make([]preauthEntry, 0, len(keys))
+	for _, key := range keys {
+		identity, err := loadIdentity(key)
+		if err != nil {
+			return nil, err
+		}
+		dk, err := loadDeviceKey(key)
+		if err != nil {
+			return nil, err
+		}
+		pubkey, err := dk.PublicPEM()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get public key of %s", key)
+		}
+		entries = append(entries, preauthEntry{
+			IdentityData: identity,
+			Pubkey:       pubkey,
+		})
+	}
+	return entries, nil
+}
+
+// writePreauthManifest writes the devices as CSV with identity_data and
+// pubkey columns if the file name ends in .csv, as a JSON list otherwise
+func writePreauthManifest(path string, entries []preauthEntry) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create preauth manifest")
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		w := csv.NewWriter(f)
+		w.Write([]string{"identity_data", "pubkey"})
+		for _, e := range entries {
+			identity, _ := json.Marshal(e.IdentityData)
+			w.Write([]string{string(identity), e.Pubkey})
+		}
+		w.Flush()
+		err = w.Error()
+	} else {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(entries)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to write preauth manifest")
+	}
+	return nil
+}
+
+// pushPreauth preauthorizes the devices through the management API;
+// devices that already exist count as preauthorized
+func pushPreauth(server, token string, entries []preauthEntry) error {
+	tr := &http.Transport{}
+	configureTLS(tr)
+	c := &http.Client{Transport: &instrumentedTransport{next: tr}}
+	url := strings.TrimRight(server, "/") + preauthPath
+
+	work := make(chan preauthEntry)
+	var lock sync.Mutex
+	failed := 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < preauthWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range work {
+				if err := preauthorize(c, url, token, e); err != nil {
+					log.Warnf("failed to preauthorize %v: %v", e.IdentityData, err)
+					lock.Lock()
+					failed++
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, e := range entries {
+		work <- e
+	}
+	close(work)
+	wg.Wait()
+
+	if failed > 0 {
+		return errors.Errorf("failed to preauthorize %d of %d devices", failed, len(entries))
+	}
+	log.Infof("preauthorized %d devices", len(entries))
+	return nil
+}
+
+func preauthorize(c *http.Client, url, token string, e preauthEntry) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusConflict:
+		return nil
+	}
+	return errors.Errorf("bad status %d", resp.StatusCode)
+}
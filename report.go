@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// API operations the summary report is broken down by
+const (
+	opAuthRequest      = "auth_request"
+	opUpdateCheck      = "update_check"
+	opInventorySubmit  = "inventory_submit"
+	opLogUpload        = "log_upload"
+	opStatusReport     = "status_report"
+	opArtifactDownload = "artifact_download"
+	opPreauthorize     = "preauthorize"
+)
+
+// latencySamples is the number of latencies kept per operation for the
+// percentiles of the summary report
+const latencySamples = 10000
+
+// outcomes of a deployment handled by a simulated device
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+	outcomeAborted = "aborted"
+)
+
+var reportOperations = []string{
+	opAuthRequest,
+	opUpdateCheck,
+	opInventorySubmit,
+	opLogUpload,
+	opStatusReport,
+	opArtifactDownload,
+	opPreauthorize,
+}
+
+// classifyRequest maps an API request to the operation it performs;
+// anything that is not an API call is an artifact download
+func classifyRequest(req *http.Request) string {
+	path := req.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/authentication/auth_requests"):
+		return opAuthRequest
+	case strings.HasSuffix(path, "/deployments/device/deployments/next"):
+		return opUpdateCheck
+	case strings.HasSuffix(path, "/inventory/device/attributes"):
+		return opInventorySubmit
+	case strings.Contains(path, "/deployments/device/deployments/") && strings.HasSuffix(path, "/log"):
+		return opLogUpload
+	case strings.Contains(path, "/deployments/device/deployments/") && strings.HasSuffix(path, "/status"):
+		return opStatusReport
+	case strings.HasSuffix(path, preauthPath):
+		return opPreauthorize
+	}
+	return opArtifactDownload
+}
+
+type opStats struct {
+	requests int
+	errors   map[string]int
+	// latencies is a uniform sample of the latencies of all requests, so
+	// long runs do not keep every one of them
+	latencies []time.Duration
+	max       time.Duration
+}
+
+type runStats struct {
+	sync.Mutex
+	start    time.Time
+	ops      map[string]*opStats
+	outcomes map[string]int
+	// refreshes counts re-authentications after a refused token, rejected
+	// holds the devices whose authorization requests keep being refused
+	refreshes int
+	rejected  map[string]bool
+}
+
+var stats = &runStats{
+	start:    time.Now(),
+	ops:      make(map[string]*opStats),
+	outcomes: make(map[string]int),
+	rejected: make(map[string]bool),
+}
+
+func (s *runStats) recordOutcome(outcome string) {
+	deploymentOutcomes.Inc(outcome)
+
+	s.Lock()
+	s.outcomes[outcome]++
+	s.Unlock()
+}
+
+func (s *runStats) recordRefresh() {
+	tokenRefreshes.Inc()
+
+	s.Lock()
+	s.refreshes++
+	s.Unlock()
+}
+
+func (s *runStats) setRejected(device string, rejected bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if rejected {
+		s.rejected[device] = true
+	} else {
+		delete(s.rejected, device)
+	}
+	rejectedDevices.Set(float64(len(s.rejected)))
+}
+
+// record accounts a finished request; errors are keyed by HTTP status, "tls"
+// if the TLS handshake failed, or "transport" if no response was received
+// for another reason
+func (s *runStats) record(op string, latency time.Duration, status int, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	o, ok := s.ops[op]
+	if !ok {
+		o = &opStats{errors: make(map[string]int)}
+		s.ops[op] = o
+	}
+	o.requests++
+	if len(o.latencies) < latencySamples {
+		o.latencies = append(o.latencies, latency)
+	} else if i := mrand.Intn(o.requests); i < latencySamples {
+		o.latencies[i] = latency
+	}
+	if latency > o.max {
+		o.max = latency
+	}
+
+	switch {
+	case isTLSError(err):
+		tlsHandshakeFailures.Inc(op)
+		o.errors["tls"]++
+	case err != nil:
+		o.errors["transport"]++
+	case status >= 400:
+		o.errors[strconv.Itoa(status)]++
+	}
+}
+
+// instrumentedTransport records every round trip in the run statistics; the
+// latency covers the whole exchange up until the response body is closed
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	op := classifyRequest(req)
+	start := time.Now()
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		stats.record(op, time.Since(start), 0, err)
+		return nil, err
+	}
+
+	resp.Body = &instrumentedBody{
+		ReadCloser: resp.Body,
+		done: func(err error) {
+			stats.record(op, time.Since(start), resp.StatusCode, err)
+		},
+	}
+	return resp, nil
+}
+
+type instrumentedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func(error)
+}
+
+func (b *instrumentedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.once.Do(func() { b.done(err) })
+	}
+	return n, err
+}
+
+func (b *instrumentedBody) Close() error {
+	b.once.Do(func() { b.done(nil) })
+	return b.ReadCloser.Close()
+}
+
+// OperationReport summarizes all requests of one API operation; latencies
+// are in milliseconds
+type OperationReport struct {
+	Requests int            `json:"requests"`
+	Errors   map[string]int `json:"errors"`
+	P50      float64        `json:"p50_ms"`
+	P90      float64        `json:"p90_ms"`
+	P99      float64        `json:"p99_ms"`
+	Max      float64        `json:"max_ms"`
+}
+
+type RunReport struct {
+	Start      time.Time                  `json:"start"`
+	End        time.Time                  `json:"end"`
+	Duration   string                     `json:"duration"`
+	Devices    int                        `json:"devices"`
+	Operations map[string]OperationReport `json:"operations"`
+	// Deployments counts the deployments handled by outcome
+	Deployments map[string]int `json:"deployments"`
+	// TokenRefreshes counts re-authentications after a refused token
+	TokenRefreshes int `json:"token_refreshes"`
+	// RejectedDevices lists the devices still being refused authorization
+	RejectedDevices []string `json:"rejected_devices"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// percentile expects the latencies to be sorted
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(latencies))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(latencies) {
+		i = len(latencies) - 1
+	}
+	return latencies[i]
+}
+
+func (s *runStats) report(devices int) RunReport {
+	s.Lock()
+	defer s.Unlock()
+
+	end := time.Now()
+	r := RunReport{
+		Start:       s.start,
+		End:         end,
+		Duration:    end.Sub(s.start).Round(time.Second).String(),
+		Devices:     devices,
+		Operations:  make(map[string]OperationReport),
+		Deployments: make(map[string]int),
+	}
+
+	for _, outcome := range []string{outcomeSuccess, outcomeFailure, outcomeAborted} {
+		r.Deployments[outcome] = s.outcomes[outcome]
+	}
+	r.TokenRefreshes = s.refreshes
+	r.RejectedDevices = sortedKeys(s.rejected)
+
+	for _, op := range reportOperations {
+		o, ok := s.ops[op]
+		if !ok {
+			r.Operations[op] = OperationReport{Errors: map[string]int{}}
+			continue
+		}
+		latencies := append([]time.Duration(nil), o.latencies...)
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+		errs := make(map[string]int)
+		for k, v := range o.errors {
+			errs[k] = v
+		}
+		r.Operations[op] = OperationReport{
+			Requests: o.requests,
+			Errors:   errs,
+			P50:      milliseconds(percentile(latencies, 50)),
+			P90:      milliseconds(percentile(latencies, 90)),
+			P99:      milliseconds(percentile(latencies, 99)),
+			Max:      milliseconds(o.max),
+		}
+	}
+	return r
+}
+
+func formatErrors(errs map[string]int) string {
+	if len(errs) == 0 {
+		return "-"
+	}
+	var keys []string
+	for k := range errs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s:%d", k, errs[k]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (r RunReport) print(out io.Writer) {
+	fmt.Fprintf(out, "\nrun finished after %s with %d devices\n\n", r.Duration, r.Devices)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "operation\trequests\terrors\tp50 ms\tp90 ms\tp99 ms\tmax ms\t")
+	for _, op := range reportOperations {
+		o := r.Operations[op]
+		fmt.Fprintf(w, "%s\t%d\t%s\t%.1f\t%.1f\t%.1f\t%.1f\t\n",
+			op, o.Requests, formatErrors(o.Errors), o.P50, o.P90, o.P99, o.Max)
+	}
+	w.Flush()
+
+	fmt.Fprintf(out, "\ndeployments: %d succeeded, %d failed, %d aborted\n",
+		r.Deployments[outcomeSuccess], r.Deployments[outcomeFailure], r.Deployments[outcomeAborted])
+	fmt.Fprintf(out, "authorization: %d token refreshes, %d devices rejected\n",
+		r.TokenRefreshes, len(r.RejectedDevices))
+}
+
+func (r RunReport) writeJSON(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// finishRun prints the summary report, writes it out as JSON if requested
+// and exits
+func finishRun(devices int, reportFile string) {
+	r := stats.report(devices)
+	r.print(os.Stdout)
+
+	if reportFile != "" {
+		if err := r.writeJSON(reportFile); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write report to %s: %v\n", reportFile, err)
+			os.Exit(1)
+		}
+		fmt.Printf("\nreport written to %s\n", reportFile)
+	}
+	os.Exit(0)
+}
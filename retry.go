@@ -0,0 +1,72 @@
+package main
+
+import (
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+)
+
+// retry profiles
+const (
+	// back off like the real client: intervals doubling from one minute up
+	// to the maximum retry interval, each tried three times, before giving up
+	retryReal = "real"
+	// retry every second, like a misbehaving client hammering the server
+	// during an outage; update checks and inventory submits are retried too
+	retryAggressive = "aggressive"
+)
+
+const (
+	aggressiveRetryInterval = time.Second
+	aggressiveRetryAttempts = 10
+)
+
+func validRetryProfile(profile string) bool {
+	switch profile {
+	case retryReal, retryAggressive:
+		return true
+	}
+	return false
+}
+
+// backoff returns how long to wait before retrying a request that failed
+// tried+1 times, false once it should be given up on
+func (c *Cohort) backoff(tried int) (time.Duration, bool) {
+	if c.Retry == retryAggressive {
+		return aggressiveRetryInterval, tried < aggressiveRetryAttempts
+	}
+	wait, err := client.GetExponentialBackoffTime(tried, time.Duration(c.RetryMaxInterval))
+	return wait, err == nil
+}
+
+// retry runs fn until it succeeds, the retry profile of the cohort gives up
+// or the device is stopped; aborted deployments and rejected tokens are not
+// retried
+func (c *Cohort) retry(op string, stop <-chan struct{}, fn func() error) error {
+	for tried := 0; ; tried++ {
+		err := fn()
+		if err == nil || err == client.ErrDeploymentAborted || isUnauthorized(err) {
+			return err
+		}
+
+		wait, ok := c.backoff(tried)
+		if !ok {
+			return err
+		}
+		requestRetries.Inc(op)
+		log.Debugf("%s failed, retrying in %v: %v", op, wait, err)
+		if !sleep(wait, stop) {
+			return err
+		}
+	}
+}
+
+// retryPeriodic is retry for requests the real client simply repeats at the
+// next interval instead, update checks and inventory submits
+func (c *Cohort) retryPeriodic(op string, stop <-chan struct{}, fn func() error) error {
+	if c.Retry != retryAggressive {
+		return fn()
+	}
+	return c.retry(op, stop, fn)
+}
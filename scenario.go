@@ -0,0 +1,513 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// duration accepts either a Go duration string ("90s", "10m") or a plain
+// number of seconds in scenario files
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*d = duration(time.Duration(value * float64(time.Second)))
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = duration(parsed)
+	default:
+		return errors.Errorf("invalid duration: %s", string(b))
+	}
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Phase is one step of a cohort timeline; the number of active devices is
+// moved linearly from the previous phase's count to Devices over Duration
+type Phase struct {
+	Name     string   `json:"name"`
+	Duration duration `json:"duration"`
+	// Devices is the number of active devices at the end of the phase,
+	// defaults to the cohort count
+	Devices *int `json:"devices"`
+}
+
+func (p Phase) target(count int) int {
+	if p.Devices == nil {
+		return count
+	}
+	return *p.Devices
+}
+
+// Cohort is a group of simulated devices sharing the same configuration
+type Cohort struct {
+	Name              string   `json:"name"`
+	Count             int      `json:"count"`
+	DeviceType        string   `json:"device_type"`
+	Artifact          string   `json:"artifact"`
+	Inventory         string   `json:"inventory"`
+	PollInterval      duration `json:"poll_interval"`
+	InventoryInterval duration `json:"inventory_interval"`
+	MaxWait           duration `json:"max_wait"`
+	FailureRatio      float64  `json:"failure_ratio"`
+	FailMessage       string   `json:"fail_message"`
+	Download          string   `json:"download"`
+	// DownloadRate limits the artifact download rate of every device
+	DownloadRate Bandwidth `json:"download_rate"`
+	// InventoryModel generates further inventory attributes of every device
+	InventoryModel InventoryModel `json:"inventory_model"`
+	// InventoryPolicy decides when devices submit their inventory
+	InventoryPolicy string `json:"inventory_policy"`
+	// Timers is the timer mode, desync or synchronized, and TimerJitter
+	// the percentage of the intervals every tick is varied by
+	Timers      string  `json:"timers"`
+	TimerJitter float64 `json:"timer_jitter"`
+	// Select picks the devices of the cohort out of the fleet
+	Select *DeviceSelection `json:"select"`
+	// KeyType is the algorithm of the keys generated for the devices
+	KeyType string `json:"key_type"`
+	// Identity is the template of the identity data of the devices
+	Identity IdentityTemplate `json:"identity"`
+	// Faults are injected into the network traffic of every device
+	Faults *Faults `json:"faults"`
+	// Retry is the retry profile of the devices, real or aggressive, and
+	// RetryMaxInterval caps the interval between retries
+	Retry            string   `json:"retry"`
+	RetryMaxInterval duration `json:"retry_max_interval"`
+	Phases           []Phase  `json:"phases"`
+
+	// inventory holds the parsed static inventory attributes
+	inventory []client.InventoryAttribute
+
+	lock              sync.Mutex
+	failCount         int
+	updatesPerformed  int
+	updatesLeftToFail int
+	paused            bool
+	// timeline is set while the phases of the cohort are run
+	timeline bool
+
+	// devices are all devices of the cohort, the first len(stops) of them
+	// are running
+	runLock sync.Mutex
+	devices []*fakeDevice
+	stops   []chan struct{}
+
+	// pollNow makes the devices check for updates right away, reconfigured
+	// restarts their timers after the intervals changed
+	pollNow      broadcast
+	reconfigured broadcast
+}
+
+// Scenario describes a whole load test
+type Scenario struct {
+	Backend string   `json:"backend"`
+	Tenant  string   `json:"tenant"`
+	Arrival *Arrival `json:"arrival"`
+	// KeysDir is the key directory the devices are taken from
+	KeysDir string `json:"keys_dir"`
+	// FleetDownloadRate caps the download rate of all devices together
+	FleetDownloadRate string    `json:"fleet_download_rate"`
+	TLS               *TLS      `json:"tls"`
+	Cohorts           []*Cohort `json:"cohorts"`
+}
+
+// defaultScenario builds a single cohort scenario out of the command line flags
+func defaultScenario() *Scenario {
+	return &Scenario{
+		FleetDownloadRate: fleetDownloadRate,
+		KeysDir:           keysDir,
+		TLS: &TLS{
+			CACert:     caCert,
+			ClientCert: clientCert,
+			ClientKey:  clientKey,
+			Insecure:   insecureTLS,
+		},
+		Arrival: &Arrival{
+			Model:    arrivalModel,
+			Duration: duration(time.Duration(arrivalDuration) * time.Second),
+			Rate:     arrivalRate,
+			Steps:    defaultArrivalSteps,
+		},
+		Cohorts: []*Cohort{{
+			Name:              "default",
+			Count:             menderClientCount,
+			DeviceType:        currentDeviceType,
+			Artifact:          currentArtifact,
+			Inventory:         inventoryItems,
+			InventoryModel:    defaultInventory,
+			InventoryPolicy:   inventoryPolicy,
+			Timers:            timerMode,
+			TimerJitter:       timerJitter,
+			PollInterval:      duration(time.Duration(pollFrequency) * time.Second),
+			InventoryInterval: duration(time.Duration(inventoryUpdateFrequency) * time.Second),
+			MaxWait:           duration(time.Duration(maxWaitSteps) * time.Second),
+			FailMessage:       updateFailMsg,
+			Download:          downloadMode,
+			DownloadRate:      defaultBandwidth,
+			Select:            defaultSelection,
+			KeyType:           keyType,
+			Identity:          defaultIdentity,
+			Retry:             retryProfile,
+			RetryMaxInterval:  duration(retryMaxInterval),
+			Faults: &Faults{
+				Latency:           duration(faultLatency),
+				Jitter:            duration(faultJitter),
+				ResetRate:         faultResetRate,
+				PartialUploadRate: faultPartialUploadRate,
+				PartialBodyRate:   faultPartialBodyRate,
+				DNSRate:           faultDNSRate,
+				TimeoutRate:       faultTimeoutRate,
+				Timeout:           duration(faultTimeout),
+			},
+			FailureRatio:      failureRatio(updateFailCount, menderClientCount),
+			failCount:         updateFailCount,
+			updatesLeftToFail: updateFailCount,
+		}},
+	}
+}
+
+// failureRatio is the share of count devices failing their updates
+func failureRatio(failCount, count int) float64 {
+	if count == 0 {
+		return 0
+	}
+	return math.Min(float64(failCount)/float64(count), 1)
+}
+
+func loadScenario(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read scenario file")
+	}
+
+	var s Scenario
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse scenario file %s", path)
+	}
+
+	if len(s.Cohorts) == 0 {
+		return nil, errors.Errorf("scenario %s does not define any cohorts", path)
+	}
+	// settings where zero is a valid value only fall back when left out
+	var fields struct {
+		Cohorts []map[string]json.RawMessage `json:"cohorts"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse scenario file %s", path)
+	}
+
+	// anything not set in the scenario falls back to the command line flags
+	defaults := defaultScenario().Cohorts[0]
+	// cohort names key their state and the control API
+	names := make(map[string]bool)
+	for i, c := range s.Cohorts {
+		set := func(field string) bool {
+			_, ok := fields.Cohorts[i][field]
+			return ok
+		}
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("cohort-%d", i)
+		}
+		if names[c.Name] {
+			return nil, errors.Errorf("scenario %s defines cohort %s more than once", path, c.Name)
+		}
+		names[c.Name] = true
+		if c.Count <= 0 {
+			return nil, errors.Errorf("cohort %s: count must be positive", c.Name)
+		}
+		if c.FailureRatio < 0 || c.FailureRatio > 1 {
+			return nil, errors.Errorf("cohort %s: failure_ratio must be between 0 and 1", c.Name)
+		}
+		for _, p := range c.Phases {
+			if p.Duration < 0 {
+				return nil, errors.Errorf("cohort %s: phase %s has a negative duration", c.Name, p.Name)
+			}
+			if t := p.target(c.Count); t < 0 || t > c.Count {
+				return nil, errors.Errorf("cohort %s: phase %s wants %d devices, cohort has %d",
+					c.Name, p.Name, t, c.Count)
+			}
+		}
+		if c.DeviceType == "" {
+			c.DeviceType = defaults.DeviceType
+		}
+		if c.Artifact == "" {
+			c.Artifact = defaults.Artifact
+		}
+		if c.Inventory == "" {
+			c.Inventory = defaults.Inventory
+		}
+		if c.inventory, err = parseInventoryItems(c.Inventory); err != nil {
+			return nil, errors.Wrapf(err, "cohort %s", c.Name)
+		}
+		if c.InventoryModel == nil {
+			c.InventoryModel = defaults.InventoryModel
+		} else if err := c.InventoryModel.validate(); err != nil {
+			return nil, errors.Wrapf(err, "cohort %s", c.Name)
+		}
+		if c.Timers == "" {
+			c.Timers = defaults.Timers
+		} else if !validTimerMode(c.Timers) {
+			return nil, errors.Errorf("cohort %s: unknown timer mode %q", c.Name, c.Timers)
+		}
+		if !set("timer_jitter") {
+			c.TimerJitter = defaults.TimerJitter
+		} else if c.TimerJitter < 0 || c.TimerJitter > 100 {
+			return nil, errors.Errorf("cohort %s: timer_jitter must be between 0 and 100", c.Name)
+		}
+		if c.InventoryPolicy == "" {
+			c.InventoryPolicy = defaults.InventoryPolicy
+		} else if !validInventoryPolicy(c.InventoryPolicy) {
+			return nil, errors.Errorf("cohort %s: unknown inventory policy %q", c.Name, c.InventoryPolicy)
+		}
+		if c.PollInterval == 0 {
+			c.PollInterval = defaults.PollInterval
+		}
+		if c.InventoryInterval == 0 {
+			c.InventoryInterval = defaults.InventoryInterval
+		}
+		if c.PollInterval <= 0 || c.InventoryInterval <= 0 {
+			return nil, errors.Errorf("cohort %s: poll_interval and inventory_interval must be positive", c.Name)
+		}
+		if !set("max_wait") {
+			c.MaxWait = defaults.MaxWait
+		} else if c.MaxWait < 0 {
+			return nil, errors.Errorf("cohort %s: max_wait must not be negative", c.Name)
+		}
+		if c.FailMessage == "" {
+			c.FailMessage = defaults.FailMessage
+		}
+		if c.Download == "" {
+			c.Download = defaults.Download
+		} else if !validDownloadMode(c.Download) {
+			return nil, errors.Errorf("cohort %s: unknown download mode %q", c.Name, c.Download)
+		}
+		if c.DownloadRate.spec == "" {
+			c.DownloadRate = defaults.DownloadRate
+		}
+		if err := c.Select.parse(); err != nil {
+			return nil, errors.Wrapf(err, "cohort %s", c.Name)
+		}
+		if c.KeyType == "" {
+			c.KeyType = defaults.KeyType
+		} else if !validKeyType(c.KeyType) {
+			return nil, errors.Errorf("cohort %s: unknown key type %q", c.Name, c.KeyType)
+		}
+		if c.Identity == nil {
+			c.Identity = defaults.Identity
+		} else if err := c.Identity.validate(); err != nil {
+			return nil, errors.Wrapf(err, "cohort %s", c.Name)
+		}
+		if c.Retry == "" {
+			c.Retry = defaults.Retry
+		} else if !validRetryProfile(c.Retry) {
+			return nil, errors.Errorf("cohort %s: unknown retry profile %q", c.Name, c.Retry)
+		}
+		if c.RetryMaxInterval == 0 {
+			c.RetryMaxInterval = defaults.RetryMaxInterval
+		}
+		if c.Faults == nil {
+			c.Faults = defaults.Faults
+		} else if c.Faults.Timeout == 0 {
+			c.Faults.Timeout = defaults.Faults.Timeout
+		}
+		if err := c.Faults.validate(); err != nil {
+			return nil, errors.Wrapf(err, "cohort %s", c.Name)
+		}
+		c.failCount = int(math.Round(c.FailureRatio * float64(c.Count)))
+		c.updatesLeftToFail = c.failCount
+	}
+
+	if s.FleetDownloadRate == "" {
+		s.FleetDownloadRate = fleetDownloadRate
+	}
+
+	if s.Arrival == nil {
+		s.Arrival = defaultScenario().Arrival
+	}
+
+	if s.TLS == nil {
+		s.TLS = defaultScenario().TLS
+	}
+
+	if s.KeysDir == "" {
+		s.KeysDir = keysDir
+	}
+
+	if s.Backend == "" {
+		s.Backend = backendHost
+	}
+	if s.Tenant == "" {
+		s.Tenant = tenantToken
+	}
+
+	return &s, nil
+}
+
+func (s *Scenario) deviceCount() int {
+	count := 0
+	for _, c := range s.Cohorts {
+		c.lock.Lock()
+		count += c.Count
+		c.lock.Unlock()
+	}
+	return count
+}
+
+// nextUpdateFails decides whether the update that is about to be performed
+// by a device of the cohort should fail
+func (c *Cohort) nextUpdateFails() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// if we performed an update for all the devices, we should reset the number of failed updates to perform
+	if c.Count > 0 && c.updatesPerformed > 0 && c.updatesPerformed%c.Count == 0 {
+		c.updatesLeftToFail = c.failCount
+	}
+	c.updatesPerformed += 1
+	defer c.save()
+
+	if len(c.FailMessage) > 0 && c.updatesLeftToFail > 0 {
+		c.updatesLeftToFail -= 1
+		return true
+	}
+	return false
+}
+
+// start adds the devices of the cohort, one per key file, and starts them
+// or, if the cohort has a timeline, runs it in the background. The devices
+// are added before start returns, so the control API never sees a cohort
+// without them.
+func (c *Cohort) start(keys []assignedKey) {
+	if err := c.load(); err != nil {
+		log.Errorf("cohort %s: failed to restore state: %v", c.Name, err)
+	}
+
+	c.addDevices(keys)
+
+	c.lock.Lock()
+	count := c.Count
+	timeline := len(c.Phases) > 0
+	c.timeline = timeline
+	c.lock.Unlock()
+
+	if !timeline {
+		c.setActive(count)
+		return
+	}
+	go c.run(count)
+}
+
+// run walks through the phases of the cohort timeline
+func (c *Cohort) run(count int) {
+	defer func() {
+		c.lock.Lock()
+		c.timeline = false
+		c.lock.Unlock()
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for _, p := range c.Phases {
+		from := c.active()
+		to := p.target(count)
+		length := time.Duration(p.Duration)
+		log.Infof("cohort %s: entering phase %s, %d -> %d devices over %v", c.Name, p.Name, from, to, length)
+
+		start := time.Now()
+		for elapsed := time.Duration(0); elapsed < length; elapsed = time.Since(start) {
+			progress := float64(elapsed) / float64(length)
+			c.setActive(from + int(float64(to-from)*progress))
+			<-ticker.C
+		}
+		c.setActive(to)
+	}
+	log.Infof("cohort %s: timeline finished with %d active devices", c.Name, c.active())
+}
+
+// addDevices adds a device per key file to the cohort, not starting them
+func (c *Cohort) addDevices(keys []assignedKey) {
+	var devices []*fakeDevice
+	for _, key := range keys {
+		identity, err := loadIdentity(key.path)
+		if err != nil {
+			log.Errorf("cohort %s: skipping device: %v", c.Name, err)
+			continue
+		}
+		dev := newFakeDevice(key.path, key.index, identity, c)
+		if err := dev.load(); err != nil {
+			log.Errorf("device %s: failed to restore state: %v", dev.name(), err)
+		}
+		devices = append(devices, dev)
+	}
+
+	c.runLock.Lock()
+	c.devices = append(c.devices, devices...)
+	c.runLock.Unlock()
+}
+
+// setActive starts or stops devices until n of them are running, as far as
+// the cohort has devices
+func (c *Cohort) setActive(n int) {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+
+	if n > len(c.devices) {
+		n = len(c.devices)
+	}
+	for len(c.stops) < n {
+		dev := c.devices[len(c.stops)]
+		stop := make(chan struct{})
+		prev, exited := dev.exited, make(chan struct{})
+		dev.exited = exited
+		go func() {
+			defer close(exited)
+			// a device stopped earlier may still be winding down, it must
+			// not run twice
+			if prev != nil {
+				select {
+				case <-prev:
+				case <-stop:
+					return
+				}
+			}
+			clientScheduler(dev, stop)
+		}()
+		c.stops = append(c.stops, stop)
+	}
+	for len(c.stops) > n {
+		close(c.stops[len(c.stops)-1])
+		c.stops = c.stops[:len(c.stops)-1]
+	}
+}
+
+// active returns the number of running devices
+func (c *Cohort) active() int {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	return len(c.stops)
+}
+
+func (c *Cohort) String() string {
+	return fmt.Sprintf("%s (%d x %s running %s)", c.Name, c.Count, c.DeviceType, c.Artifact)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeScenario(t *testing.T, scenario string) (string, func()) {
+	dir, err := ioutil.TempDir("", "scenario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "scenario.json")
+	if err := ioutil.WriteFile(path, []byte(scenario), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadScenarioKeepsExplicitZeros(t *testing.T) {
+	path, cleanup := writeScenario(t, `{"cohorts": [
+		{"name": "zero", "count": 1, "max_wait": 0, "timer_jitter": 0},
+		{"name": "unset", "count": 1}
+	]}`)
+	defer cleanup()
+
+	s, err := loadScenario(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero, unset := s.Cohorts[0], s.Cohorts[1]
+	if zero.MaxWait != 0 || zero.TimerJitter != 0 {
+		t.Errorf("explicit zeros replaced: max_wait %v, timer_jitter %v",
+			time.Duration(zero.MaxWait), zero.TimerJitter)
+	}
+	defaults := defaultScenario().Cohorts[0]
+	if unset.MaxWait != defaults.MaxWait || unset.TimerJitter != defaults.TimerJitter {
+		t.Errorf("left out settings do not fall back: max_wait %v, timer_jitter %v",
+			time.Duration(unset.MaxWait), unset.TimerJitter)
+	}
+}
+
+func TestLoadScenarioRefusesDuplicateCohorts(t *testing.T) {
+	tests := []string{
+		`{"cohorts": [{"name": "a", "count": 1}, {"name": "a", "count": 1}]}`,
+		// the second cohort is named cohort-1 when left unnamed
+		`{"cohorts": [{"name": "cohort-1", "count": 1}, {"count": 1}]}`,
+	}
+	for _, scenario := range tests {
+		path, cleanup := writeScenario(t, scenario)
+		if _, err := loadScenario(path); err == nil {
+			t.Errorf("%s: expected an error", scenario)
+		}
+		cleanup()
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+)
+
+// maximum number of update history entries kept per device
+const maxHistory = 100
+
+// stateStore keeps simulated device state across restarts; nil if state
+// persistence is disabled
+var stateStore store.Store
+
+// deviceState is what is persisted for every device
+type deviceState struct {
+	ArtifactName string           `json:"artifact_name"`
+	DeviceType   string           `json:"device_type"`
+	AuthToken    string           `json:"auth_token,omitempty"`
+	DeviceID     string           `json:"device_id,omitempty"`
+	Deployment   *deploymentState `json:"deployment,omitempty"`
+	History      []updateRecord   `json:"history,omitempty"`
+}
+
+// cohortState is the persisted failure budget of a cohort
+type cohortState struct {
+	UpdatesPerformed  int `json:"updates_performed"`
+	UpdatesLeftToFail int `json:"updates_left_to_fail"`
+}
+
+func openStateStore(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create state directory")
+	}
+	stateStore = store.NewDirStore(dir)
+	return nil
+}
+
+func loadState(name string, v interface{}) (bool, error) {
+	if stateStore == nil {
+		return false, nil
+	}
+	data, err := stateStore.ReadAll(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, errors.Wrapf(err, "corrupt state entry %s", name)
+	}
+	return true, nil
+}
+
+func saveState(name string, v interface{}) {
+	if stateStore == nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = stateStore.WriteAll(name, data)
+	}
+	if err != nil {
+		log.Warnf("failed to save state %s: %v", name, err)
+	}
+}
+
+// save persists the device state; the device lock must be held
+func (d *fakeDevice) save() {
+	saveState("device-"+d.name()+".json", deviceState{
+		ArtifactName: d.artifactName,
+		DeviceType:   d.deviceType,
+		AuthToken:    string(d.token),
+		DeviceID:     d.claims.DeviceID,
+		Deployment:   d.deployment,
+		History:      d.history,
+	})
+}
+
+// load restores the device state saved by an earlier run, if any
+func (d *fakeDevice) load() error {
+	var s deviceState
+	found, err := loadState("device-"+d.name()+".json", &s)
+	if err != nil || !found {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.artifactName = s.ArtifactName
+	d.deviceType = s.DeviceType
+	d.token = client.AuthToken(s.AuthToken)
+	// claims of a token that cannot be parsed are left empty, the backend
+	// rejects the token anyway
+	d.claims, _ = parseTokenClaims(s.AuthToken)
+	d.tokenIssued = time.Now()
+	d.deployment = s.Deployment
+	d.history = s.History
+	return nil
+}
+
+// save persists the failure budget; the cohort lock must be held
+func (c *Cohort) save() {
+	saveState("cohort-"+c.Name+".json", cohortState{
+		UpdatesPerformed:  c.updatesPerformed,
+		UpdatesLeftToFail: c.updatesLeftToFail,
+	})
+}
+
+func (c *Cohort) load() error {
+	var s cohortState
+	found, err := loadState("cohort-"+c.Name+".json", &s)
+	if err != nil || !found {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.updatesPerformed = s.UpdatesPerformed
+	c.updatesLeftToFail = s.UpdatesLeftToFail
+	return nil
+}
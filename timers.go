@@ -0,0 +1,80 @@
+package main
+
+import (
+	mrand "math/rand"
+	"time"
+)
+
+// timer modes
+const (
+	// devices start their poll and inventory timers at a random offset,
+	// so devices started together do not hit the backend at once (default)
+	timersDesync = "desync"
+	// all devices fire at the same multiples of the interval on the wall
+	// clock, sending their requests in bursts
+	timersSynchronized = "synchronized"
+)
+
+func validTimerMode(mode string) bool {
+	switch mode {
+	case timersDesync, timersSynchronized:
+		return true
+	}
+	return false
+}
+
+// deviceTimer fires every interval of a device, varied by the jitter, a
+// share of the interval; in synchronized mode it fires on the multiples of
+// the interval instead. The interval is looked up every time, as it may be
+// changed through the control API.
+type deviceTimer struct {
+	*time.Timer
+	interval     func() time.Duration
+	jitter       float64
+	synchronized bool
+}
+
+// newTimer starts a timer of the device
+func (c *Cohort) newTimer(interval func() time.Duration, jitter float64) *deviceTimer {
+	t := &deviceTimer{
+		interval:     interval,
+		jitter:       jitter,
+		synchronized: c.Timers == timersSynchronized,
+	}
+	t.Timer = time.NewTimer(t.first())
+	return t
+}
+
+// first returns how long until the timer first fires, a random offset
+// within the interval
+func (t *deviceTimer) first() time.Duration {
+	if t.synchronized {
+		return t.next()
+	}
+	return time.Duration(mrand.Int63n(int64(t.interval()))) + 1
+}
+
+// next returns how long until the timer fires again
+func (t *deviceTimer) next() time.Duration {
+	interval := t.interval()
+	if t.synchronized {
+		return interval - time.Duration(time.Now().UnixNano()%int64(interval))
+	}
+	return time.Duration(float64(interval) * (1 + t.jitter*(2*mrand.Float64()-1)))
+}
+
+// rearm sets the timer for the next time after it fired
+func (t *deviceTimer) rearm() {
+	t.Reset(t.next())
+}
+
+// restart starts the timer over, e.g. after its interval changed
+func (t *deviceTimer) restart() {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(t.first())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TLS configures how devices connect to the backend over HTTPS
+type TLS struct {
+	// CACert is a PEM bundle of CA certificates trusted on top of the system
+	// ones to verify the server certificate
+	CACert string `json:"ca_cert"`
+	// ClientCert and ClientKey are the PEM certificate and key presented to
+	// backends requiring mutual TLS
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+	// Insecure skips verifying the server certificate
+	Insecure bool `json:"insecure"`
+}
+
+// backendTLS is the TLS configuration of all connections to the backend
+var backendTLS = &tls.Config{}
+
+// config builds the TLS client configuration
+func (t *TLS) config() (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: t.Insecure}
+
+	if t.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := ioutil.ReadFile(t.CACert)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read CA certificates")
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no certificates found in %s", t.CACert)
+		}
+		conf.RootCAs = pool
+	}
+
+	if (t.ClientCert == "") != (t.ClientKey == "") {
+		return nil, errors.New("a client certificate needs both a certificate and a key")
+	}
+	if t.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(t.ClientCert, t.ClientKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load client certificate")
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// configureTLS applies backendTLS to the transport, keeping the protocols
+// negotiated through ALPN, e.g. by http2.ConfigureTransport
+func configureTLS(tr *http.Transport) {
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+	tr.TLSClientConfig.RootCAs = backendTLS.RootCAs
+	tr.TLSClientConfig.Certificates = backendTLS.Certificates
+	tr.TLSClientConfig.InsecureSkipVerify = backendTLS.InsecureSkipVerify
+}
+
+// isTLSError tells whether a request failed during the TLS handshake, e.g.
+// on an untrusted server certificate or a refused client certificate
+func isTLSError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "x509: ") || strings.Contains(msg, "tls: ")
+}